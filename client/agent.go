@@ -0,0 +1,44 @@
+package client
+
+import (
+	"errors"
+	"net"
+	"os"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+
+// dialAgent connects to the agent listening on `SSH_AUTH_SOCK`.
+func dialAgent() (net.Conn, error) {
+	sock := os.Getenv("SSH_AUTH_SOCK")
+	if len(sock) == 0 {
+		return nil, errors.New("agent: SSH_AUTH_SOCK is not set")
+	}
+	return net.Dial("unix", sock)
+}
+
+// checkForAgentAuth returns an `ssh.AuthMethod` backed by the running
+// ssh-agent, along with the connection to the agent, or nils if there is no
+// agent to talk to.  The connection is used again on reconnects, so it is
+// kept open until the client is closed.  The keys offered by the agent are
+// reported to `log`.
+func checkForAgentAuth(log verboseLogger) (ssh.AuthMethod, net.Conn) {
+	conn, err := dialAgent()
+	if err != nil {
+		log.printf(1, "Not using ssh-agent: %s", err)
+		return nil, nil
+	}
+	log.printf(1, "Using ssh-agent at %s", os.Getenv("SSH_AUTH_SOCK"))
+
+	keyring := agent.NewClient(conn)
+	return ssh.PublicKeysCallback(func() ([]ssh.Signer, error) {
+		signers, err := keyring.Signers()
+		for i, k := range signers {
+			signers[i] = log.signer("ssh-agent", k)
+		}
+		return signers, err
+	}), conn
+}
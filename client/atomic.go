@@ -0,0 +1,86 @@
+package client
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"path"
+
+	"github.com/pkg/sftp"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+
+// remoteTempPrefix starts the names of the temporary files which transfers are
+// written to before they are renamed into place, see `Options.InPlace`.
+const remoteTempPrefix = ".pssh-tmp-"
+
+// remoteTempPath returns a temporary path in the same directory as `remote`,
+// so that it can be renamed over `remote` without crossing filesystems.
+func remoteTempPath(remote string) string {
+	bs := make([]byte, 6)
+	rand.Read(bs)
+	return path.Join(path.Dir(remote), remoteTempPrefix+hex.EncodeToString(bs))
+}
+
+// writeAtomic calls `write` to write `sz` bytes to a temporary file alongside
+// `remote`, and renames it over `remote` once it is complete.  Readers on the
+// remote see either the old or the new contents, never a partial file.  If
+// the size of the temporary file can be checked it must be `sz`, unless `sz`
+// is negative.  With `InPlace` set `write` writes to `remote` directly.
+func (c *Client) writeAtomic(remote string, sz int64, write func(dst string) error) error {
+	if c.opts.InPlace {
+		return write(remote)
+	}
+
+	tmp := remoteTempPath(remote)
+	err := write(tmp)
+	if sc := c.sftpSession(); err == nil && sc != nil && sz >= 0 {
+		if fi, serr := sc.Stat(tmp); serr != nil {
+			err = serr
+		} else if fi.Size() != sz {
+			err = fmt.Errorf("short write, %d of %d bytes written to %s", fi.Size(), sz, tmp)
+		}
+	}
+	if err == nil {
+		err = c.renameRemote(tmp, remote)
+	}
+	if err != nil {
+		c.removeRemoteTemp(tmp)
+	}
+	return err
+}
+
+// renameRemote renames the remote path `from` to `to`, replacing `to` if it
+// exists.
+func (c *Client) renameRemote(from, to string) error {
+	if sc := c.sftpSession(); sc != nil {
+		return sftpRename(sc, from, to)
+	}
+	return c.runRemoteCommand(c.shell.rename(from, to))
+}
+
+// sftpOpUnsupported is the status of sftp requests the server does not know.
+const sftpOpUnsupported = 8
+
+// sftpRename renames `from` to `to` over sftp, replacing `to` if it exists.
+// The plain v3 rename fails if the target exists, so the posix-rename
+// extension is used unless the server does not support it.
+func sftpRename(sc *sftp.Client, from, to string) error {
+	err := sc.PosixRename(from, to)
+	if serr, ok := err.(*sftp.StatusError); !ok || serr.Code != sftpOpUnsupported {
+		return err
+	}
+	sc.Remove(to)
+	return sc.Rename(from, to)
+}
+
+// removeRemoteTemp removes the temporary file `tmp` after a failed transfer.
+// This is best effort, as the connection may be why the transfer failed.
+func (c *Client) removeRemoteTemp(tmp string) {
+	if sc := c.sftpSession(); sc != nil {
+		sc.Remove(tmp)
+		return
+	}
+	c.runRemoteCommand(c.shell.remove(tmp))
+}
@@ -0,0 +1,315 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+
+// sumCacheEntry is the checksum of a local file, which is valid as long as
+// its size and modification time are unchanged.
+type sumCacheEntry struct {
+	Size    int64  `json:"size"`
+	ModTime int64  `json:"mod_time"`
+	SHA256  string `json:"sha256"`
+}
+
+// sumCache remembers the checksums of local files between runs so that an
+// unchanged tree does not need to be hashed again.
+type sumCache struct {
+	lock    sync.Mutex
+	path    string // file the cache is stored in, "" if it cannot be saved
+	entries map[string]sumCacheEntry
+	dirty   bool
+}
+
+// loadSumCache loads the checksum cache for `localDir` from the user's cache
+// directory.  A missing or corrupt cache is treated as empty.
+func loadSumCache(localDir string) *sumCache {
+	ret := &sumCache{entries: map[string]sumCacheEntry{}}
+
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ret
+	}
+	h := sha256.Sum256([]byte(localDir))
+	ret.path = filepath.Join(dir, "pssh", "sums-"+hex.EncodeToString(h[:8])+".json")
+
+	if bs, err := ioutil.ReadFile(ret.path); err == nil {
+		json.Unmarshal(bs, &ret.entries)
+	}
+	return ret
+}
+
+// sum returns the checksum of the local file `f` at `local`, hashing it only if
+// it has changed since it was last cached.
+func (s *sumCache) sum(f *os.File, local string) (string, error) {
+	stat, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	s.lock.Lock()
+	e, ok := s.entries[local]
+	s.lock.Unlock()
+	if ok && e.Size == stat.Size() && e.ModTime == stat.ModTime().UnixNano() {
+		return e.SHA256, nil
+	}
+
+	sum, err := hashFile(f)
+	if err != nil {
+		return "", err
+	}
+
+	s.lock.Lock()
+	s.entries[local] = sumCacheEntry{Size: stat.Size(), ModTime: stat.ModTime().UnixNano(), SHA256: sum}
+	s.dirty = true
+	s.lock.Unlock()
+	return sum, nil
+}
+
+// save writes the cache back to disk if it has changed.
+func (s *sumCache) save() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if !s.dirty || len(s.path) == 0 {
+		return nil
+	}
+	bs, err := json.Marshal(s.entries)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0700); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(s.path, bs, 0600); err != nil {
+		return err
+	}
+	s.dirty = false
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// remoteChecksums returns the sha256 of every file in the remote directory,
+// keyed by remote path.  A missing remote directory has no files.
+func (c *Client) remoteChecksums() (map[string]string, error) {
+	ret := map[string]string{}
+	if err := c.readChecksums(c.shell.checksums(c.remoteDir), ret); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// remoteFileChecksums returns the sha256 of each of the remote files `paths`
+// which exists, keyed by remote path.
+func (c *Client) remoteFileChecksums(paths []string) (map[string]string, error) {
+	ret := map[string]string{}
+	for _, cmd := range c.shell.fileChecksums(paths) {
+		if err := c.readChecksums(cmd, ret); err != nil {
+			return nil, err
+		}
+	}
+	return ret, nil
+}
+
+// readChecksums runs the remote command `cmd` and adds each "<hash>  <path>"
+// line it prints to `sums`.  Files which could not be read are left out, but
+// a command which fails without printing anything is an error.
+func (c *Client) readChecksums(cmd string, sums map[string]string) error {
+	out, err := c.runRemoteCommandOutput(cmd)
+	if err != nil && len(out) == 0 {
+		return err
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), "  ", 2)
+		if len(parts) == 2 {
+			sums[parts[1]] = parts[0]
+		}
+	}
+	return scanner.Err()
+}
+
+// loadRemoteSums fetches the checksums of the remote copies of the local
+// `files`, so that unchanged files can be skipped, unless `Force` is set.
+// When the remote directory can be listed over sftp, only the files whose size
+// matches the local one are hashed.  If the checksums are unavailable a warning
+// is printed and every file is sent.
+func (c *Client) loadRemoteSums(files []string) {
+	if c.opts.Force {
+		return
+	}
+	listing, listed := c.remoteFileInfo()
+
+	paths := []string{}
+	for _, f := range files {
+		absLocal, err := filepath.Abs(f)
+		if err != nil {
+			continue
+		}
+		remote, err := c.remotePathFor(absLocal)
+		if err != nil {
+			continue
+		}
+		if listed {
+			fi, ok := listing[remote]
+			if !ok {
+				continue
+			}
+			if lfi, err := os.Stat(absLocal); err != nil || lfi.Size() != fi.Size() {
+				continue
+			}
+		}
+		paths = append(paths, remote)
+	}
+
+	sums := map[string]string{}
+	if len(paths) > 0 {
+		var err error
+		if sums, err = c.remoteFileChecksums(paths); err != nil {
+			c.status(fmt.Sprintf("Warning: remote checksums unavailable, sending every file (%s)", err.Error()))
+			sums = map[string]string{}
+		}
+	}
+	modes := map[string]string{}
+	for p, fi := range listing {
+		modes[p] = fmt.Sprintf("%04o", fi.Mode().Perm())
+	}
+
+	c.sumsLock.Lock()
+	c.remoteSums = sums
+	c.remoteModes = modes
+	c.sumsLock.Unlock()
+}
+
+// remoteFileInfo lists the files in the remote directory over sftp, keyed by
+// remote path, and returns false if it could not be listed.  A missing remote
+// directory has no files.  Without sftp modes are known once files are synced.
+func (c *Client) remoteFileInfo() (map[string]os.FileInfo, bool) {
+	sc := c.sftpSession()
+	if sc == nil {
+		return nil, false
+	}
+	files, err := c.remoteFiles(sc)
+	if os.IsNotExist(err) {
+		return nil, true
+	} else if err != nil {
+		return nil, false
+	}
+	ret := map[string]os.FileInfo{}
+	for rel, fi := range files {
+		ret[path.Join(c.remoteDir, rel)] = fi
+	}
+	return ret, true
+}
+
+// unchanged returns true if the remote file at `remote` is known to have the
+// same contents as the local file `f`.  The local checksum is returned so it
+// can be recorded once the file is sent.
+func (c *Client) unchanged(f *os.File, local, remote string) (bool, string) {
+	if c.opts.Force || c.transformFor(local) != nil {
+		return false, ""
+	}
+
+	sum, err := c.sums.sum(f, local)
+	if err != nil {
+		return false, ""
+	}
+
+	c.sumsLock.Lock()
+	defer c.sumsLock.Unlock()
+	return c.remoteSums[remote] == sum, sum
+}
+
+// recordRemoteSum notes that `remote` now has the checksum `sum`.
+func (c *Client) recordRemoteSum(remote, sum string) {
+	if len(sum) == 0 {
+		return
+	}
+	c.sumsLock.Lock()
+	defer c.sumsLock.Unlock()
+	if c.remoteSums == nil {
+		c.remoteSums = map[string]string{}
+	}
+	c.remoteSums[remote] = sum
+}
+
+// forgetRemoteSum drops the recorded checksum, time and mode of `remote`,
+// after it was removed.
+func (c *Client) forgetRemoteSum(remote string) {
+	c.sumsLock.Lock()
+	defer c.sumsLock.Unlock()
+	delete(c.remoteSums, remote)
+	delete(c.remoteTimes, remote)
+	delete(c.remoteModes, remote)
+}
+
+// remoteTimeStale returns true if `remote` was given a modification time other
+// than `mtime` when it was last synced.  Files whose time is not known, such
+// as those already on the remote at startup, are taken to be up to date so
+// that an unchanged tree costs nothing to sync.
+func (c *Client) remoteTimeStale(remote string, mtime time.Time) bool {
+	c.sumsLock.Lock()
+	defer c.sumsLock.Unlock()
+	t, ok := c.remoteTimes[remote]
+	if !ok {
+		if c.remoteTimes == nil {
+			c.remoteTimes = map[string]time.Time{}
+		}
+		c.remoteTimes[remote] = mtime
+		return false
+	}
+	return !t.Equal(mtime)
+}
+
+// recordRemoteTime notes that `remote` now has the modification time `mtime`.
+func (c *Client) recordRemoteTime(remote string, mtime time.Time) {
+	c.sumsLock.Lock()
+	defer c.sumsLock.Unlock()
+	if c.remoteTimes == nil {
+		c.remoteTimes = map[string]time.Time{}
+	}
+	c.remoteTimes[remote] = mtime
+}
+
+// remoteModeStale returns true if `remote` was given permissions other than
+// `perms` when it was last synced.  Like `remoteTimeStale`, files whose
+// permissions are not known are taken to be up to date.
+func (c *Client) remoteModeStale(remote, perms string) bool {
+	c.sumsLock.Lock()
+	defer c.sumsLock.Unlock()
+	m, ok := c.remoteModes[remote]
+	if !ok {
+		if c.remoteModes == nil {
+			c.remoteModes = map[string]string{}
+		}
+		c.remoteModes[remote] = perms
+		return false
+	}
+	return m != perms
+}
+
+// recordRemoteMode notes that `remote` now has the octal permissions `perms`.
+func (c *Client) recordRemoteMode(remote, perms string) {
+	c.sumsLock.Lock()
+	defer c.sumsLock.Unlock()
+	if c.remoteModes == nil {
+		c.remoteModes = map[string]string{}
+	}
+	c.remoteModes[remote] = perms
+}
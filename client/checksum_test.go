@@ -0,0 +1,74 @@
+package client
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func sha256Hex(s string) string {
+	h := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(h[:])
+}
+
+func TestBatchCommands(t *testing.T) {
+	cmd := func(args string) string { return "[" + args + "]" }
+	for _, tc := range []struct {
+		args []string
+		max  int
+		want []string
+	}{
+		{nil, 10, []string{}},
+		{[]string{"a", "b", "c"}, 10, []string{"[a b c]"}},
+		{[]string{"a", "b", "c"}, 5, []string{"[a b c]"}},
+		{[]string{"a", "b", "c"}, 4, []string{"[a b]", "[c]"}},
+		{[]string{"aaaa", "b", "cc"}, 4, []string{"[aaaa]", "[b cc]"}},
+		// An argument over the limit still gets a command of its own.
+		{[]string{"a", "toolong", "b"}, 3, []string{"[a]", "[toolong]", "[b]"}},
+	} {
+		if got := batchCommands(tc.args, " ", tc.max, cmd); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("batchCommands(%q, %d) = %q, want %q", tc.args, tc.max, got, tc.want)
+		}
+	}
+}
+
+func TestLoadRemoteSums(t *testing.T) {
+	local, remote := t.TempDir(), t.TempDir()
+	for name, data := range map[string]string{"same": "same", "changed": "new", "missing": "missing"} {
+		if err := ioutil.WriteFile(filepath.Join(local, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, data := range map[string]string{"same": "same", "changed": "old", "other": "other"} {
+		if err := ioutil.WriteFile(filepath.Join(remote, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Only the remote copies of the local files are hashed, those which are
+	// missing are left out without an error.
+	c := newLocalClient(t, local, remote, Options{})
+	files, _, err := c.localTree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.loadRemoteSums(files)
+	want := map[string]string{
+		filepath.Join(remote, "same"):    sha256Hex("same"),
+		filepath.Join(remote, "changed"): sha256Hex("old"),
+	}
+	if !reflect.DeepEqual(c.remoteSums, want) {
+		t.Errorf("remoteSums = %v, want %v", c.remoteSums, want)
+	}
+}
+
+func TestRemoteChecksumsMissingDir(t *testing.T) {
+	c := newLocalClient(t, t.TempDir(), filepath.Join(t.TempDir(), "missing"), Options{})
+	sums, err := c.remoteChecksums()
+	if err != nil || len(sums) != 0 {
+		t.Errorf("remoteChecksums = %v, %v, want no files", sums, err)
+	}
+}
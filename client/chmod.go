@@ -0,0 +1,68 @@
+package client
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+
+// ChmodRule gives the files matching `Pattern` the permissions `Mode` on the
+// remote, see `Options.ChmodRules`.  Like `Include`, a pattern containing a
+// slash is matched against the slash separated path relative to the local
+// directory, and others against the base name.
+type ChmodRule struct {
+	Pattern string
+	Mode    os.FileMode
+}
+
+// ParseChmodRule parses a rule of the form `pattern=mode`, where the mode is
+// in octal, ex: "*.sh=0755".
+func ParseChmodRule(s string) (ChmodRule, error) {
+	parts := strings.SplitN(s, "=", 2)
+	if len(parts) != 2 || len(parts[0]) == 0 {
+		return ChmodRule{}, fmt.Errorf("expected pattern=mode, got %q", s)
+	}
+	if _, err := path.Match(parts[0], ""); err != nil {
+		return ChmodRule{}, fmt.Errorf("invalid pattern %q: %s", parts[0], err.Error())
+	}
+	mode, err := strconv.ParseUint(parts[1], 8, 32)
+	if err != nil || mode > 0777 {
+		return ChmodRule{}, fmt.Errorf("invalid mode %q, expected octal permissions (ex: 0644)", parts[1])
+	}
+	return ChmodRule{Pattern: parts[0], Mode: os.FileMode(mode)}, nil
+}
+
+// remotePerms returns the octal permissions for the remote copy of the local
+// file `local`, described by `fi`.  The first of the `ChmodRules` which
+// matches decides them, otherwise they are those of the local file.
+func (c *Client) remotePerms(local string, fi os.FileInfo) string {
+	rel, base := filepath.ToSlash(c.relPath(local)), filepath.Base(local)
+	for _, r := range c.opts.ChmodRules {
+		name := base
+		if strings.Contains(r.Pattern, "/") {
+			name = rel
+		}
+		if ok, _ := path.Match(r.Pattern, name); ok {
+			return fmt.Sprintf("%04o", r.Mode.Perm())
+		}
+	}
+	return fmt.Sprintf("%04o", fi.Mode().Perm())
+}
+
+// setRemoteMode sets the permissions of `remote` to the octal `perms`, for a
+// file whose contents are already up to date.
+func (c *Client) setRemoteMode(remote, perms string) error {
+	if sc := c.sftpSession(); sc != nil {
+		mode, err := strconv.ParseUint(perms, 8, 32)
+		if err != nil {
+			return fmt.Errorf("invalid permissions %q: %s", perms, err.Error())
+		}
+		return sc.Chmod(remote, os.FileMode(mode))
+	}
+	return c.runRemoteCommand(c.shell.chmod(remote, perms))
+}
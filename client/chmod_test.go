@@ -0,0 +1,117 @@
+package client
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseChmodRule(t *testing.T) {
+	for _, tc := range []struct {
+		s       string
+		pattern string
+		mode    os.FileMode
+		ok      bool
+	}{
+		{"*.sh=0755", "*.sh", 0755, true},
+		{"bin/*=755", "bin/*", 0755, true},
+		{"a=b=0600", "a", 0, false},
+		{"secret=0600", "secret", 0600, true},
+		{"*.sh", "", 0, false},
+		{"=0755", "", 0, false},
+		{"*.sh=", "", 0, false},
+		{"*.sh=0999", "", 0, false},
+		{"*.sh=01777", "", 0, false},
+		{"*.sh=rwx", "", 0, false},
+		{"[=0644", "", 0, false},
+	} {
+		r, err := ParseChmodRule(tc.s)
+		if (err == nil) != tc.ok {
+			t.Errorf("ParseChmodRule(%q) error = %v, want ok=%v", tc.s, err, tc.ok)
+			continue
+		}
+		if tc.ok && (r.Pattern != tc.pattern || r.Mode != tc.mode) {
+			t.Errorf("ParseChmodRule(%q) = %q %04o, want %q %04o", tc.s, r.Pattern, r.Mode, tc.pattern, tc.mode)
+		}
+	}
+}
+
+func TestRemotePerms(t *testing.T) {
+	local := t.TempDir()
+	rules := []ChmodRule{}
+	for _, s := range []string{"bin/*=0700", "*.sh=0755", "*=0640"} {
+		r, err := ParseChmodRule(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rules = append(rules, r)
+	}
+
+	for _, tc := range []struct {
+		rel   string
+		mode  os.FileMode
+		rules []ChmodRule
+		want  string
+	}{
+		// Without rules the local permissions are kept.
+		{"a.txt", 0644, nil, "0644"},
+		{"run.sh", 0751, nil, "0751"},
+		// The first matching rule wins.
+		{"run.sh", 0644, rules, "0755"},
+		{"bin/run.sh", 0644, rules, "0700"},
+		{"a.txt", 0600, rules, "0640"},
+		// Patterns without a slash match the base name at any depth, those
+		// with one match the path from the local directory.
+		{"sub/run.sh", 0644, rules, "0755"},
+		{"sub/bin/tool", 0644, rules, "0640"},
+		{"bin/sub/tool", 0644, rules[:2], "0644"},
+	} {
+		p := filepath.Join(local, filepath.FromSlash(tc.rel))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, nil, tc.mode); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chmod(p, tc.mode); err != nil {
+			t.Fatal(err)
+		}
+		fi, err := os.Stat(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		c := newLocalClient(t, local, "/srv/app", Options{ChmodRules: tc.rules})
+		if got := c.remotePerms(p, fi); got != tc.want {
+			t.Errorf("remotePerms(%q) with %d rules = %s, want %s", tc.rel, len(tc.rules), got, tc.want)
+		}
+	}
+}
+
+func TestSyncFileChmodRule(t *testing.T) {
+	local, remote := t.TempDir(), t.TempDir()
+	r, err := ParseChmodRule("*.sh=0750")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newLocalClient(t, local, remote, Options{ChmodRules: []ChmodRule{r}})
+
+	for _, name := range []string{"run.sh", "a.txt"} {
+		if err := ioutil.WriteFile(filepath.Join(local, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.syncFile(filepath.Join(local, name), filepath.Join(remote, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, want := range map[string]os.FileMode{"run.sh": 0750, "a.txt": 0644} {
+		fi, err := os.Stat(filepath.Join(remote, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Mode().Perm() != want {
+			t.Errorf("%s synced with mode %v, want %v", name, fi.Mode().Perm(), want)
+		}
+	}
+}
@@ -1,375 +1,2502 @@
 package client
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"os"
+	"os/exec"
 	"os/user"
 	"path"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
-	"syscall"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/pkg/sftp"
 	"github.com/rjeczalik/notify"
 	"github.com/sabhiram/sshaddr"
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/crypto/ssh/terminal"
+	"golang.org/x/time/rate"
 )
 
 ////////////////////////////////////////////////////////////////////////////////
 
+// passphraseAttempts is the number of times the user is prompted for the
+// passphrase of an encrypted private key before giving up.
+const passphraseAttempts = 3
+
+// isEncryptedKeyError returns true if `err` is the error returned when parsing
+// a passphrase protected private key without a passphrase.
+func isEncryptedKeyError(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "cannot decode encrypted private keys")
+}
+
+// parsePrivateKey parses the private key `bs` read from the file `pkf`.  If the
+// key is passphrase protected, the user is prompted for the passphrase.
+func parsePrivateKey(pkf string, bs []byte, redactPaths bool) (ssh.Signer, error) {
+	k, err := ssh.ParsePrivateKey(bs)
+	if isUnhandledKeyTypeError(err) {
+		return parseOpenSSHECDSAKey(bs)
+	}
+	if !isEncryptedKeyError(err) {
+		return k, err
+	}
+
+	name := pkf
+	if redactPaths {
+		name = Redact(pkf)
+	}
+	if isOpenSSHKey(bs) {
+		return nil, fmt.Errorf("key %s is passphrase protected in the openssh format, which cannot be decrypted; "+
+			"add it to ssh-agent, or for rsa and ecdsa keys convert it with `ssh-keygen -p -m PEM -f %s`", name, name)
+	}
+
+	// Keys are loaded for several hosts at once, keep their prompts apart.
+	promptLock.Lock()
+	defer promptLock.Unlock()
+	for i := 0; i < passphraseAttempts; i++ {
+		fmt.Printf("Enter passphrase for key '%s': ", name)
+		pass, err := readPassword()
+		fmt.Printf("\n")
+		if err != nil {
+			return nil, err
+		}
+
+		k, err = ssh.ParsePrivateKeyWithPassphrase(bs, pass)
+		if err != x509.IncorrectPasswordError {
+			return k, err
+		}
+		fmt.Printf("Bad passphrase, try again.\n")
+	}
+	return nil, fmt.Errorf("too many incorrect passphrases for key %s", name)
+}
+
 // checkForUserCertAuth returns any valid `ssh.AuthMethod`s available for the
-// specified user.  Permission errors should be treated correctly to allow
+// local user.  Permission errors should be treated correctly to allow
 // correct execution.  It is valid for this function to return nil, nil to
-// signal that nothing major went wrong but that we found no valid certs.
-func checkForUserCertAuth(username string) ([]ssh.AuthMethod, error) {
+// signal that nothing major went wrong but that we found no valid certs.  If
+// `identity` is set, only that key is loaded and it must exist.  Otherwise the
+// keys are looked for in `sshDir`, or the local user's ~/.ssh if it is empty,
+// whichever user is being logged in as on the remote.  The key files which
+// are tried are reported to `log`.
+func checkForUserCertAuth(identity, sshDir string, log verboseLogger) ([]ssh.AuthMethod, error) {
 	ret := []ssh.AuthMethod{}
 
-	u, err := user.Lookup(username)
+	if len(identity) > 0 {
+		log.printf(2, "Using identity file %s", identity)
+		bs, err := ioutil.ReadFile(identity)
+		if err != nil {
+			return nil, err
+		}
+		k, err := parsePrivateKey(identity, bs, log.redact)
+		if err != nil {
+			return nil, err
+		}
+		return append(ret, ssh.PublicKeys(log.signer(identity, k))), nil
+	}
+
+	if len(sshDir) == 0 {
+		u, err := user.Current()
+		if err != nil {
+			return nil, err
+		}
+		sshDir = path.Join(u.HomeDir, ".ssh")
+	}
+
+	log.printf(2, "Looking for keys in %s", sshDir)
+	for _, pkf := range userKeyFiles(sshDir) {
+		log.printf(2, "Trying key file %s", pkf)
+		if _, err := os.Stat(pkf); err == nil {
+			bs, err := ioutil.ReadFile(pkf)
+			if err != nil {
+				return nil, err
+			}
+
+			k, err := parsePrivateKey(pkf, bs, log.redact)
+			if err != nil {
+				// Anything matching `id_*` may not be a key at all, and
+				// one bad key should not prevent trying the others.
+				log.printf(1, "Skipping key file %s: %s", pkf, err.Error())
+				continue
+			}
+
+			// Each key is its own auth method so that the server can accept
+			// whichever one it knows about.
+			ret = append(ret, ssh.PublicKeys(log.signer(pkf, k)))
+		}
+	}
+	return ret, nil
+}
+
+// defaultKeyFiles are the private key names tried first, in order of
+// preference, before any other `id_*` files in the ssh directory.
+var defaultKeyFiles = []string{"id_ed25519", "id_ecdsa", "id_rsa", "id_dsa"}
+
+// userKeyFiles returns the candidate private key files in the ssh directory
+// `base`.  Public keys and certificates are skipped.
+func userKeyFiles(base string) []string {
+	ret := []string{}
+	seen := map[string]bool{}
+	for _, k := range defaultKeyFiles {
+		pkf := path.Join(base, k)
+		ret = append(ret, pkf)
+		seen[pkf] = true
+	}
+
+	matches, _ := filepath.Glob(path.Join(base, "id_*"))
+	sort.Strings(matches)
+	for _, pkf := range matches {
+		if seen[pkf] || strings.HasSuffix(pkf, ".pub") {
+			continue
+		}
+		if fi, err := os.Stat(pkf); err != nil || !fi.Mode().IsRegular() {
+			continue
+		}
+		ret = append(ret, pkf)
+	}
+	return ret
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// markerFile is the name of the file in the remote directory which holds the
+// hash of the last fully synced local tree.
+const markerFile = ".pssh-marker"
+
+// DefaultMaxClockSkew is the largest difference between the local and remote
+// clocks which is tolerated without a warning.
+const DefaultMaxClockSkew = 5 * time.Second
+
+// DefaultMaxSessions matches the default `MaxSessions` of OpenSSH's sshd.
+const DefaultMaxSessions = 10
+
+// SSHDirEnv names the environment variable which sets the default
+// `Options.SSHDir`, for environments where keys are mounted somewhere other
+// than ~/.ssh.
+const SSHDirEnv = "PSSH_SSH_DIR"
+
+// DefaultTimeout is how long to wait for the TCP connection to the remote.
+const DefaultTimeout = 10 * time.Second
+
+// eventBuffer is the number of watcher events which can be queued while the
+// client is busy.  The watcher drops events rather than wait for room, which
+// loses changes and splits up the two sides of a rename.
+const eventBuffer = 1024
+
+// DefaultSyncWorkers is the number of files transferred at once during the
+// initial sync, and of changes synced at once after it.
+const DefaultSyncWorkers = 4
+
+// DefaultSCPPath runs whichever scp is first on the remote PATH.
+const DefaultSCPPath = "scp"
+
+////////////////////////////////////////////////////////////////////////////////
+
+// sharedConn is an ssh connection shared by every `Client` for the same
+// `user@addr`, see `dialShared`.
+type sharedConn struct {
+	client *ssh.Client
+	closed bool          // `client` has gone away, and is redialed by the next user
+	slots  chan struct{} // see `sessionSlots`
+	refs   int           // `Client`s using it, see `releaseShared`
+}
+
+var (
+	connsLock sync.Mutex
+	conns     = map[string]*sharedConn{} // keyed by `user@addr`
+)
+
+// dialShared returns the ssh connection for `user@addr`, dialing it only if
+// there is not already one open.  This allows many `Client`s which point at
+// the same host to share a single connection.  Each call must be paired with
+// a `releaseShared` once the connection is no longer needed.
+func dialShared(addr string, config *ssh.ClientConfig) (*ssh.Client, error) {
+	connsLock.Lock()
+	defer connsLock.Unlock()
+
+	key := config.User + "@" + addr
+	if sc, ok := conns[key]; ok && !sc.closed {
+		sc.refs++
+		return sc.client, nil
+	}
+
+	client, err := dialSSH(addr, config)
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return nil, fmt.Errorf("connection to %s timed out after %s", addr, config.Timeout)
+	} else if err != nil {
+		return nil, err
+	}
+	sc, ok := conns[key]
+	if !ok {
+		sc = &sharedConn{}
+		conns[key] = sc
+	}
+	sc.client, sc.closed = client, false
+	sc.refs++
+	go watchShared(key, client)
+	return client, nil
+}
+
+// watchShared marks the shared connection for `key` as closed once `client`
+// goes away, so that it is redialed rather than handed out again.
+func watchShared(key string, client *ssh.Client) {
+	client.Wait()
+
+	connsLock.Lock()
+	defer connsLock.Unlock()
+	if sc, ok := conns[key]; ok && sc.client == client {
+		sc.closed = true
+	}
+}
+
+// releaseShared drops a reference to the shared connection for `user@addr`
+// taken by `dialShared`.  The last one to go closes the connection.
+func releaseShared(addr string, config *ssh.ClientConfig) {
+	connsLock.Lock()
+	defer connsLock.Unlock()
+
+	key := config.User + "@" + addr
+	sc, ok := conns[key]
+	if !ok {
+		return
+	}
+	if sc.refs--; sc.refs <= 0 {
+		delete(conns, key)
+		sc.client.Close()
+	}
+}
+
+// sessionSlots returns the semaphore which limits the sessions open on
+// `client`, see `MaxSessions`.  Every `Client` sharing a connection shares its
+// semaphore, so that together they stay within the server's limit, even after
+// it is redialed.  Without a shared connection, ex: containers, each caller
+// gets its own.
+func sessionSlots(client *ssh.Client, n int) chan struct{} {
+	if client == nil {
+		return make(chan struct{}, n)
+	}
+
+	connsLock.Lock()
+	defer connsLock.Unlock()
+	for _, sc := range conns {
+		if sc.client == client {
+			if sc.slots == nil {
+				sc.slots = make(chan struct{}, n)
+			}
+			return sc.slots
+		}
+	}
+	return make(chan struct{}, n)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// Options configures optional behavior of a `Client`.
+type Options struct {
+	// Dedup links files whose contents already exist on the remote instead of
+	// transferring them again.
+	Dedup bool
+
+	// Marker records a hash of the local tree on the remote after a complete
+	// initial sync, and skips the initial sync when it is unchanged.
+	Marker bool
+
+	// Delta only sends the data which is not found in some block of the remote
+	// copy, at any offset, for files which are at least `DeltaMinSize` bytes.
+	// The remote file is rebuilt alongside the old one and renamed over it.
+	Delta        bool
+	DeltaMinSize int64
+
+	// MaxClockSkew is the largest tolerated difference between the local and
+	// remote clocks, defaults to `DefaultMaxClockSkew` if unset.  If
+	// `StrictClock` is set, a larger skew is an error rather than a warning.
+	MaxClockSkew time.Duration
+	StrictClock  bool
+
+	// MaxSessions is the number of sessions which may be open at once on the
+	// connection.  Defaults to `DefaultMaxSessions` if unset.
+	MaxSessions int
+
+	// Insecure skips verifying the remote host key against known_hosts.
+	Insecure bool
+
+	// Redact hides home directory paths and anything resembling a secret in
+	// status output.
+	Redact bool
+
+	// SyncFirst completes the initial sync before starting the shell.
+	SyncFirst bool
+
+	// CommandRetries is the number of times a remote command is retried if it
+	// could not be run, for example because the session failed to open.
+	CommandRetries int
+
+	// TransferRetries is the number of times a file transfer is retried if
+	// it fails, waiting `TransferRetryDelay` before the first retry and twice
+	// as long before each one after.  The delay defaults to
+	// `DefaultTransferRetryDelay`.
+	TransferRetries    int
+	TransferRetryDelay time.Duration
+
+	// ExcludeVCS skips version control metadata directories: .git, .svn,
+	// .hg, .bzr, CVS and _darcs.  They are pruned from walks of the local
+	// tree, and changes inside them are ignored.
+	ExcludeVCS bool
+
+	// Include restricts syncing to files matching one of these glob
+	// patterns, if any are given.  It is checked before the other ignore
+	// rules, which still apply to matching files.  A pattern containing a
+	// slash is matched against the path relative to the local directory,
+	// otherwise against the file name.
+	Include []string
+
+	// Extensions restricts syncing to files with one of these extensions, if
+	// any are given.  Extensions are matched case-insensitively.
+	Extensions []string
+
+	// Manifest is a local path to write a JSON manifest of every file synced
+	// during the run to.  A copy is also stored in the remote directory.  With
+	// several targets each has its own manifest, see `targetManifestPath`.
+	Manifest string
+
+	// Port overrides the port given in the address.
+	Port int
+
+	// User is the remote user to log in as, overriding the one given in the
+	// address or ~/.ssh/config.  Keys are still those of the local user.
+	User string
+
+	// Identity is the path of a private key to authenticate with instead of
+	// the default keys in ~/.ssh.
+	Identity string
+
+	// SSHDir is the directory the default keys are looked for in, in place
+	// of ~/.ssh.  Defaults to $PSSH_SSH_DIR, see `SSHDirEnv`.
+	SSHDir string
+
+	// RemoteDir overrides the destination directory given in the address.
+	RemoteDir string
+
+	// RemoteDirs mirrors the local directory into each of these directories
+	// on every host, in place of the one in the address, see `NewGroup`.
+	RemoteDirs []string
+
+	// KeepAlive is the interval between keepalive requests, which stop idle
+	// connections from being dropped and detect dead ones.  Zero disables
+	// keepalives.
+	KeepAlive time.Duration
+
+	// LogJSON reports events and their results as one JSON object per line,
+	// instead of human readable status lines.
+	LogJSON bool
+
+	// Quiet drops informational output, leaving only errors.  With
+	// `LogJSON` only events which failed are logged.  Prompts for passwords
+	// and host keys are still shown.
+	Quiet bool
+
+	// Force transfers every file, rather than skipping those whose remote
+	// copy has the same checksum.
+	Force bool
+
+	// ChmodRules decide the permissions of files on the remote, the first
+	// rule to match a file wins.  Files which match none get the permissions
+	// of the local file.  Files which are hardlinked with `Dedup` share the
+	// permissions of the file they are linked to.
+	ChmodRules []ChmodRule
+
+	// StripPrefix is removed from the front of the paths of files under it,
+	// relative to the local directory, to give their paths relative to the
+	// remote directory.  AddPrefix is then added to the front of every path.
+	// For example "src/foo" and "dist" put src/foo/bar.js at dist/bar.js.
+	// Files which map to the same remote path overwrite each other.  Both
+	// are slash separated, and unset by default so that the remote mirrors
+	// the local directory.
+	StripPrefix string
+	AddPrefix   string
+
+	// Delete removes files from the remote directory which have no local
+	// counterpart after the initial sync, for example because they were
+	// removed while pssh was not running.  Otherwise they are reported.
+	// Files which are ignored locally are left alone.
+	Delete bool
+
+	// InPlace writes transfers straight to their destination.  Otherwise
+	// they are written to a temporary file alongside it which is renamed
+	// into place once complete, so that the remote never sees a partial
+	// file.  `Delta` always patches files in place.
+	InPlace bool
+
+	// DryRun reports what would be synced without changing the remote.
+	DryRun bool
+
+	// MaxFileSize skips, with a warning, files larger than this many bytes.
+	// Zero syncs files of any size.
+	MaxFileSize int64
+
+	// Compress gzips files of at least `CompressMinSize` bytes in transit,
+	// if they appear to be compressible.  The remote needs `gzip`.
+	Compress        bool
+	CompressMinSize int64
+
+	// MaxRetries is the number of times to try to reconnect after the
+	// connection is lost before giving up.  Zero gives up immediately.
+	MaxRetries int
+
+	// Debounce is how long a path must be quiet before its changes are
+	// synced, so that a burst of events causes a single transfer.  Zero syncs
+	// every event as it arrives.
+	Debounce time.Duration
+
+	// IdleTimeout stops the client, with `ErrIdleTimeout`, once this long
+	// passes after the initial sync without a change to the local directory.
+	// Zero waits for changes forever.
+	IdleTimeout time.Duration
+
+	// FollowNewDirs subscribes to each directory created after startup, for
+	// platforms where the recursive watch does not pick them up on its own.
+	// Where it does, changes under the new directory are seen twice, which
+	// `Debounce` folds into one.  It has no effect with `NonRecursive`.
+	FollowNewDirs bool
+
+	// NonRecursive only watches and syncs the files directly inside the
+	// local directory, ignoring subdirectories.
+	NonRecursive bool
+
+	// SyncEditorTemp syncs editor swap, backup and temporary files, which are
+	// skipped by default.  See `editorTempPatterns`.
+	SyncEditorTemp bool
+
+	// Symlinks is what to do with symbolic links in the local directory, one
+	// of `SymlinksFollow` (the default), `SymlinksCopy` or `SymlinksSkip`.
+	// Changes inside a followed directory are only picked up by the initial
+	// sync, since the watcher does not follow links.
+	Symlinks string
+
+	// SyncWorkers is the number of files transferred at once during the
+	// initial sync, and of changed paths synced at once after it.  Defaults
+	// to `DefaultSyncWorkers`.
+	SyncWorkers int
+
+	// AllowRoot allows syncing to the root directory of the remote, which is
+	// refused otherwise as it is almost certainly a mistake.
+	AllowRoot bool
+
+	// RemoteOS selects the syntax of the commands run on the remote to
+	// manage files, one of `RemoteOSPOSIX` (the default) or `RemoteOSWindows`.
+	// Options which rely on POSIX utilities on the remote are not available
+	// with `RemoteOSWindows`.
+	RemoteOS string
+
+	// Transfer selects how files are written to the remote, one of
+	// `TransferAuto` (the default), `TransferSFTP` or `TransferSCP`.  With
+	// `TransferSCP` no sftp session is opened, so anything else which would
+	// use it falls back to remote commands.
+	Transfer string
+
+	// SCPPath is the scp binary run on the remote when sftp is unavailable,
+	// defaults to `DefaultSCPPath` which is resolved through the remote PATH.
+	SCPPath string
+
+	// RateLimit caps the combined rate of all transfers in bytes per second,
+	// shared by every host of a `Group`, 0 for unlimited.
+	RateLimit int64
+
+	// Timeout is how long to wait for the TCP connection to the remote,
+	// defaults to `DefaultTimeout`.  The ssh handshake after it is not
+	// limited since it may be waiting on the user for a password.
+	Timeout time.Duration
+
+	// Verbose prints how the connection is made, 1 for each step and the keys
+	// which are offered and accepted, 2 to also list every key file tried.
+	Verbose int
+
+	// VerboseOutput is where the `Verbose` output is written, defaults to
+	// stderr.
+	VerboseOutput io.Writer
+
+	// TTYEcho asks the remote pty to echo input, for shells which do not echo
+	// it themselves.  See `setupTerminalForSession`.
+	TTYEcho bool
+
+	// NoTimes leaves synced files with the time they were written on the
+	// remote, instead of the modification time of the local file.
+	NoTimes bool
+
+	// ShellCmd is an interactive command to run instead of the login shell.
+	ShellCmd string
+
+	// PostCmd is run on the remote after the initial sync, with its output
+	// printed as status lines.  With `PostCmdOnChange` it is also run after
+	// each burst of changes has been synced.
+	PostCmd         string
+	PostCmdOnChange bool
+
+	// MaxOpenFiles is the number of local files which may be open for
+	// transfer at once.  Defaults to `DefaultMaxOpenFiles()` if unset.
+	MaxOpenFiles int
+
+	// limiter enforces `RateLimit` across every `Client` of a `Group`, nil
+	// for each to have its own.
+	limiter *rate.Limiter
+}
+
+// Client wraps a `ssh.Client` which can monitor the file system for changes.
+type Client struct {
+	*ssh.Client // Client `is-a` *ssh.Client
+
+	config *ssh.ClientConfig     // ssh connection config
+	events chan notify.EventInfo // events channel for watched changes
+	opts   Options               // optional behavior
+
+	sessions  chan struct{} // one slot per open session, see `MaxSessions`
+	openFiles chan struct{} // one slot per open local file, see `MaxOpenFiles`
+	limiter   *rate.Limiter // shared by all transfers, nil if unlimited
+
+	localDir  string // Local directory to keep in sync
+	localFile string // the only file in `localDir` to sync, if set
+	remoteDir string // Remote directory to push files to
+	recursive bool   // watch and sync subdirectories of `localDir`
+
+	followed followedDirs // see `FollowNewDirs`
+
+	target *containerTarget // set when syncing to a container instead of over ssh
+	shell  remoteShell      // builds the commands run on the remote
+	sftp   *sftp.Client     // persistent sftp session, nil if unsupported
+
+	transfer transferer // selected by `Transfer` for the connection, see `openSFTP`
+	agent    net.Conn   // ssh-agent used to authenticate, nil if there is none
+
+	transforms []transform // applied to matching files before upload
+
+	manifestLock sync.Mutex
+	manifest     map[string]ManifestEntry // remote path -> entry, see `Manifest`
+
+	dedupLock  sync.Mutex        // guards `dedupIndex`
+	dedupIndex map[string]string // sha256 -> remote path, used by `Dedup`
+
+	sums        *sumCache            // checksums of local files
+	sumsLock    sync.Mutex           // guards `remoteSums`, `remoteTimes` and `remoteModes`
+	remoteSums  map[string]string    // remote path -> sha256, unless `Force`
+	remoteTimes map[string]time.Time // remote path -> modification time synced
+	remoteModes map[string]string    // remote path -> octal permissions synced
+
+	inFlight inFlight // remote paths being transferred
+	postCmds inFlight // `PostCmd` while it is running, see `afterChange`
+
+	failures int32        // changes which failed to sync, see `Failures`
+	stats    statsCounter // see `Stats`
+	label    string       // prefixed to status output when part of a `Group`
+
+	ctx      context.Context    // cancelled by `Close` to stop syncing
+	cancel   context.CancelFunc // cancels `ctx`
+	loopLock sync.Mutex         // orders `StartShell` against `Close`
+	loop     sync.WaitGroup     // held while `StartShell` is running
+	connErr  error              // why the client stopped, see `Err`
+
+	addr     string        // host:port to redial when the connection drops
+	connLock sync.RWMutex  // guards the connection, `sftp`, `down` and `gen`
+	down     chan struct{} // closed on reconnection, nil while connected
+	gen      int           // incremented on each reconnection
+}
+
+// withDefaults fills in the unset `opts` with their defaults, and checks that
+// the rest are valid.
+func withDefaults(opts Options) (Options, error) {
+	if opts.MaxSessions <= 0 {
+		opts.MaxSessions = DefaultMaxSessions
+	}
+	if opts.MaxOpenFiles <= 0 {
+		opts.MaxOpenFiles = DefaultMaxOpenFiles()
+	}
+	if opts.MaxClockSkew <= 0 {
+		opts.MaxClockSkew = DefaultMaxClockSkew
+	}
+	if opts.SyncWorkers <= 0 {
+		opts.SyncWorkers = DefaultSyncWorkers
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultTimeout
+	}
+	if opts.TransferRetryDelay <= 0 {
+		opts.TransferRetryDelay = DefaultTransferRetryDelay
+	}
+	if len(opts.SSHDir) == 0 {
+		opts.SSHDir = os.Getenv(SSHDirEnv)
+	}
+	switch opts.Symlinks {
+	case "":
+		opts.Symlinks = SymlinksFollow
+	case SymlinksFollow, SymlinksCopy, SymlinksSkip:
+	default:
+		return opts, fmt.Errorf("unknown symlink policy %q, expected %s, %s or %s", opts.Symlinks, SymlinksFollow, SymlinksCopy, SymlinksSkip)
+	}
+	if len(opts.Transfer) == 0 {
+		opts.Transfer = TransferAuto
+	}
+	if err := checkTransfer(opts); err != nil {
+		return opts, err
+	}
+	if err := checkRemap(opts); err != nil {
+		return opts, err
+	}
+	if err := checkRemoteOS(opts); err != nil {
+		return opts, err
+	}
+	return opts, nil
+}
+
+// remoteAddr is an address resolved against ~/.ssh/config and the options.
+type remoteAddr struct {
+	user, pass string
+	host       string
+	port       int
+	remoteDir  string
+}
+
+// hostPort returns the address to dial.
+func (a remoteAddr) hostPort() string {
+	return net.JoinHostPort(a.host, strconv.Itoa(a.port))
+}
+
+// resolveAddr parses `addr`, which may be an alias from ~/.ssh/config whose
+// settings are used unless the address or options say otherwise.  The
+// identity file from the config is filled in to the returned options.
+func resolveAddr(addr string, opts Options, log verboseLogger) (remoteAddr, Options, error) {
+	hostCfg, addr, err := hostConfigFor(addr)
+	if err != nil {
+		return remoteAddr{}, opts, err
+	}
+	if len(hostCfg.HostName) > 0 || len(hostCfg.User) > 0 || hostCfg.Port > 0 || len(hostCfg.IdentityFiles) > 0 {
+		log.printf(1, "Applying ssh config: HostName=%q User=%q Port=%d IdentityFile=%v",
+			hostCfg.HostName, hostCfg.User, hostCfg.Port, hostCfg.IdentityFiles)
+	}
+
+	// sshaddr splits on colons, so IPv6 literals are set aside while it
+	// parses the rest of the address.
+	bracketed, addr := unbracketHost(addr)
+	ssha, err := sshaddr.Parse(addr)
+	if err != nil {
+		return remoteAddr{}, opts, err
+	}
+
+	ra := remoteAddr{
+		user:      ssha.User(),
+		pass:      ssha.Pass(),
+		host:      ssha.Host(),
+		port:      ssha.Port(),
+		remoteDir: ssha.Destination(),
+	}
+	if len(bracketed) > 0 {
+		ra.host = bracketed
+	}
+	if len(hostCfg.HostName) > 0 {
+		ra.host = hostCfg.HostName
+	}
+	if len(opts.User) > 0 {
+		ra.user = opts.User
+	}
+	if opts.Port > 0 {
+		ra.port = opts.Port
+	} else if hostCfg.Port > 0 && !addrHasPort(addr) {
+		ra.port = hostCfg.Port
+	}
+	if len(opts.Identity) == 0 {
+		opts.Identity = hostCfg.identityFile()
+	}
+	if len(opts.RemoteDir) > 0 {
+		ra.remoteDir = opts.RemoteDir
+	}
+	log.printf(1, "Parsed address: user=%s host=%s port=%d remote=%s password=%t", ra.user, ra.host, ra.port, ra.remoteDir, len(ra.pass) > 0)
+	return ra, opts, nil
+}
+
+// New returns a ssh client which can watch files for changes.  Addresses of
+// the form `docker://container:/path` or `k8s://pod:/path` sync into a
+// container using the local `docker` or `kubectl` tools instead of ssh.  If
+// `localDir` is a file rather than a directory, only that file is synced.
+func New(addr, localDir string, opts Options) (*Client, error) {
+	opts, err := withDefaults(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	log := newVerboseLogger(opts)
+
+	if target, remoteDir, ok := parseContainerAddr(addr); ok {
+		log.printf(1, "Syncing into a container with %v", target.exec)
+		if opts.Transfer == TransferSFTP {
+			return nil, errors.New("sftp is not available when syncing into a container")
+		}
+		if len(opts.RemoteDir) > 0 {
+			remoteDir = opts.RemoteDir
+		}
+		return newClient(nil, nil, target, localDir, remoteDir, opts)
+	}
+
+	ra, opts, err := resolveAddr(addr, opts, log)
+	if err != nil {
+		return nil, err
+	}
+	user, pass, host, auth := ra.user, ra.pass, ra.host, []ssh.AuthMethod{}
+
+	var agentConn net.Conn
+	closeAgent := func() {
+		if agentConn != nil {
+			agentConn.Close()
+		}
+	}
+	if len(pass) == 0 {
+		// No pass specified - try the ssh-agent first if one is running.
+		var agentAuth ssh.AuthMethod
+		if agentAuth, agentConn = checkForAgentAuth(log); agentAuth != nil {
+			auth = append(auth, agentAuth)
+		}
+
+		// Check for cert based auth.
+		cert_auths, err := checkForUserCertAuth(opts.Identity, opts.SSHDir, log)
+		if err != nil {
+			closeAgent()
+			return nil, err
+		}
+		auth = append(auth, cert_auths...)
+		log.printf(1, "Found %d private keys", len(cert_auths))
+
+		// Password not specified and the key files are missing, or the
+		// password is in the environment, see `passwordFor`.  This is done
+		// lazily so that there is no prompt if the agent is able to
+		// authenticate us.
+		if len(cert_auths) == 0 || len(os.Getenv(PasswordEnv)) > 0 {
+			auth = append(auth, ssh.PasswordCallback(func() (string, error) {
+				log.printf(1, "Trying password authentication")
+				return passwordFor(user, host, log)
+			}))
+		}
+	} else {
+		auth = append(auth, ssh.Password(pass))
+	}
+
+	hostKeyCallback := ssh.InsecureIgnoreHostKey()
+	if !opts.Insecure {
+		hostKeyCallback, err = knownHostsCallback()
+		if err != nil {
+			closeAgent()
+			return nil, err
+		}
+	}
+
+	config := &ssh.ClientConfig{
+		User:            user,
+		Auth:            auth,
+		HostKeyCallback: log.hostKeyCallback(hostKeyCallback),
+		Timeout:         opts.Timeout,
+		BannerCallback: func(banner string) error {
+			log.printf(2, "Server banner: %s", strings.TrimSpace(banner))
+			return nil
+		},
+	}
+
+	c, err := connect(ra.hostPort(), config, localDir, ra.remoteDir, opts, log)
+	if err != nil {
+		closeAgent()
+		return nil, err
+	}
+	c.agent = agentConn
+	return c, nil
+}
+
+// NewWithConfig is `New` for callers who bring their own ssh configuration,
+// for example to choose the ciphers or check host keys themselves.  `cfg` is
+// used as it is, instead of looking for keys, agents and known_hosts.  The
+// address is still parsed for the host, port and remote directory, and its
+// user is only used if `cfg` does not name one.  `Options.User` overrides
+// both.  Container addresses are not supported, as they do not use ssh.
+func NewWithConfig(addr, localDir string, cfg *ssh.ClientConfig, opts Options) (*Client, error) {
+	opts, err := withDefaults(opts)
+	if err != nil {
+		return nil, err
+	}
+	if _, _, ok := parseContainerAddr(addr); ok {
+		return nil, fmt.Errorf("%s is a container, which does not use ssh", addr)
+	}
+
+	log := newVerboseLogger(opts)
+	ra, opts, err := resolveAddr(addr, opts, log)
 	if err != nil {
 		return nil, err
 	}
+	if len(cfg.User) == 0 || len(opts.User) > 0 {
+		withUser := *cfg
+		withUser.User = ra.user
+		cfg = &withUser
+	}
+	return connect(ra.hostPort(), cfg, localDir, ra.remoteDir, opts, log)
+}
+
+// connect dials `hostPort` with `config`, sharing an existing connection if
+// there is one, and returns a `Client` for it.
+func connect(hostPort string, config *ssh.ClientConfig, localDir, remoteDir string, opts Options, log verboseLogger) (*Client, error) {
+	log.printf(1, "Connecting to %s as %s", hostPort, config.User)
+	start := time.Now()
+	client, err := dialShared(hostPort, config)
+	if err != nil {
+		log.printf(1, "Connection to %s failed after %s", hostPort, time.Since(start))
+		return nil, err
+	}
+	log.printf(1, "Authenticated to %s (%s) in %s", hostPort, client.ServerVersion(), time.Since(start))
+
+	if !opts.Quiet {
+		fmt.Printf("Connected!\n")
+	}
+
+	c, err := newClient(client, config, nil, localDir, remoteDir, opts)
+	if err != nil {
+		releaseShared(hostPort, config)
+		return nil, err
+	}
+	c.addr = hostPort
+	c.monitor(client)
+	return c, nil
+}
+
+// newClient returns a `Client` for an established connection, or a container
+// `target`, after checking that the remote directory can be written to.
+func newClient(client *ssh.Client, config *ssh.ClientConfig, target *containerTarget, localDir, remoteDir string, opts Options) (*Client, error) {
+	// Resolve the local directory once so that the paths we walk, the paths
+	// reported by the watcher and `localDir` all share the same prefix even
+	// if `localDir` is (or is under) a symlink.
+	localDir, err := filepath.Abs(localDir)
+	if err != nil {
+		return nil, err
+	}
+	localDir, err = filepath.EvalSymlinks(localDir)
+	if err != nil {
+		return nil, err
+	}
+
+	// A single file is watched through its parent directory, and synced into
+	// the remote directory.
+	localFile := ""
+	if fi, err := os.Stat(localDir); err != nil {
+		return nil, err
+	} else if fi.Mode().IsRegular() {
+		localFile, localDir = localDir, filepath.Dir(localDir)
+	}
+
+	shell, err := newRemoteShell(opts.RemoteOS)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.limiter == nil {
+		opts.limiter = newRateLimiter(opts.RateLimit)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &Client{
+		Client: client,
+
+		config: config,
+		events: make(chan notify.EventInfo, eventBuffer),
+		opts:   opts,
+
+		sessions:  sessionSlots(client, opts.MaxSessions),
+		openFiles: make(chan struct{}, opts.MaxOpenFiles),
+		limiter:   opts.limiter,
+		stats:     statsCounter{started: time.Now()},
+
+		localDir:  localDir,
+		localFile: localFile,
+		remoteDir: remoteDir,
+		recursive: !opts.NonRecursive && len(localFile) == 0,
+		sums:      loadSumCache(localDir),
+
+		target: target,
+		shell:  shell,
+
+		ctx:    ctx,
+		cancel: cancel,
+	}
+
+	if client != nil {
+		if err := c.openSFTP(); err != nil {
+			return nil, err
+		}
+	} else if target != nil {
+		c.transfer = containerTransfer{c: c}
+	}
+
+	// Without a remote directory, sync into the remote user's home rather
+	// than wherever the paths would otherwise be rooted.
+	if len(c.remoteDir) == 0 {
+		home, err := c.remoteHome()
+		if err != nil {
+			return nil, fmt.Errorf("no remote directory given, and unable to find the remote home directory: %s", err)
+		}
+		c.status(fmt.Sprintf("No remote directory given, syncing to %s", home))
+		c.remoteDir = home
+	}
+	if path.Clean(c.remoteDir) == "/" && !opts.AllowRoot {
+		return nil, errors.New("refusing to sync to / on the remote, see -allow-root")
+	}
+
+	if !opts.DryRun {
+		if err := c.checkRemoteWritable(); err != nil {
+			return nil, err
+		}
+	}
+	if err := c.checkClockSkew(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// openSFTP starts the sftp session used for transfers and selects the
+// `transferer` for the connection.  If the server does not offer the sftp
+// subsystem, a `scp` is run per file instead, unless `Transfer` insists on
+// sftp.  The sftp session holds one of the `MaxSessions` slots for as long as
+// it is open.
+func (c *Client) openSFTP() error {
+	var sc *sftp.Client
+	var t transferer = scpTransfer{c: c}
+	var serr error
+	if c.opts.Transfer != TransferSCP {
+		c.sessions <- struct{}{}
+		var err error
+		if sc, err = sftp.NewClient(c.conn()); err != nil {
+			<-c.sessions
+			sc = nil
+			if c.opts.Transfer == TransferSFTP {
+				t = sftpTransfer{c: c}
+				serr = fmt.Errorf("sftp unavailable: %s", err.Error())
+			} else {
+				c.status(fmt.Sprintf("Warning: sftp unavailable, falling back to scp (%s)", err.Error()))
+			}
+		} else {
+			t = sftpTransfer{c: c, sc: sc}
+		}
+	}
+
+	c.connLock.Lock()
+	c.sftp = sc
+	c.transfer = t
+	c.connLock.Unlock()
+	return serr
+}
+
+// sftpSession returns the current sftp session, or nil if there is none.
+func (c *Client) sftpSession() *sftp.Client {
+	c.connLock.RLock()
+	defer c.connLock.RUnlock()
+	return c.sftp
+}
+
+// checkClockSkew compares the remote clock against the local one and warns if
+// they differ by more than `MaxClockSkew`, or fails if `StrictClock` is set.
+func (c *Client) checkClockSkew() error {
+	start := time.Now()
+	out, err := c.runRemoteCommandOutput(c.shell.now())
+	if err != nil {
+		return err
+	}
+	secs, err := strconv.ParseInt(strings.TrimSpace(string(out)), 10, 64)
+	if err != nil {
+		return fmt.Errorf("unable to parse remote time %q", out)
+	}
+
+	// Compare against the local time half way through the round trip.
+	local := start.Add(time.Since(start) / 2)
+	skew := time.Unix(secs, 0).Sub(local).Round(time.Second)
+	if skew < 0 {
+		skew = -skew
+	}
+	if skew <= c.opts.MaxClockSkew {
+		return nil
+	}
+
+	msg := fmt.Sprintf("remote clock differs from local clock by %s", skew)
+	if c.opts.StrictClock {
+		return fmt.Errorf("%s", msg)
+	}
+	c.status("Warning: " + msg)
+	return nil
+}
+
+// remoteHome returns the home directory of the remote user.
+func (c *Client) remoteHome() (string, error) {
+	if sc := c.sftpSession(); sc != nil {
+		if home, err := sc.Getwd(); err == nil && path.IsAbs(home) {
+			return home, nil
+		}
+	}
+	out, err := c.runRemoteCommandOutput(c.shell.home())
+	if err != nil {
+		return "", err
+	}
+	home := strings.TrimSpace(string(out))
+	if len(home) == 0 {
+		return "", errors.New("empty home directory")
+	}
+	return home, nil
+}
+
+// checkRemoteWritable verifies that we are able to create files in the remote
+// directory by creating and removing a temporary file in it.  This catches
+// permission problems up front rather than part way through a session.
+func (c *Client) checkRemoteWritable() error {
+	if err := c.runRemoteCommand(c.shell.writeTest(c.remoteDir)); err != nil {
+		return fmt.Errorf("remote directory not writable: %s (%s)", c.remoteDir, err)
+	}
+	return nil
+}
+
+// status prints `msg` on a line of its own, see `statusLine`.
+func (c *Client) status(msg string) error {
+	if c.opts.Quiet {
+		return nil
+	}
+	if c.opts.LogJSON {
+		c.logJSON(logEntry{Event: "status", Message: msg})
+		return nil
+	}
+
+	stdoutStatus.println(c.redact(c.labelled(msg)))
+	return nil
+}
+
+// syncError reports that the change to `path` could not be synced, and counts
+// it towards `Failures`.  Transfers cut short by `Close` are not failures.
+func (c *Client) syncError(path string, err error) {
+	if err == context.Canceled {
+		return
+	}
+	atomic.AddInt32(&c.failures, 1)
+	if c.opts.LogJSON {
+		return // included in the JSON for the event
+	}
+	stdoutStatus.fprintln(os.Stderr, c.redact(c.labelled(fmt.Sprintf("error  :: %s: %s", path, err.Error()))))
+}
+
+// labelled prefixes `msg` with the client's label, if it has one.
+func (c *Client) labelled(msg string) string {
+	if len(c.label) == 0 {
+		return msg
+	}
+	return fmt.Sprintf("[%s] %s", c.label, msg)
+}
+
+// Failures returns the number of changes which have failed to sync since the
+// client was created.
+func (c *Client) Failures() int {
+	return int(atomic.LoadInt32(&c.failures))
+}
+
+// setupTerminalForSession puts the local terminal `in` into raw mode and
+// requests a pty for `sess` of the same size as the terminal `out`.
+//
+// In raw mode the local terminal never echoes, so whatever is typed only shows
+// up once the remote sends it back.  Interactive shells with line editing
+// (bash, zsh, ...) draw the input themselves and expect the pty to start with
+// echo off, while asking the pty to echo as well makes some remotes print each
+// character twice.  `echo` turns on echo in the remote pty for remotes whose
+// shell does not echo on its own, where typing would otherwise be invisible.
+func setupTerminalForSession(in, out int, sess *ssh.Session, echo bool) (*terminal.State, error) {
+	modes := ssh.TerminalModes{
+		ssh.ECHO:          0,
+		ssh.TTY_OP_ISPEED: 14400,
+		ssh.TTY_OP_OSPEED: 14400,
+	}
+	if echo {
+		modes[ssh.ECHO] = 1
+	}
+
+	w, h, err := terminal.GetSize(out)
+	if err != nil {
+		return nil, err
+	}
+
+	termState, err := terminal.MakeRaw(in)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := sess.RequestPty("xterm-256color", h, w, modes); err != nil {
+		restoreTerminal(in, termState)
+		return nil, err
+	}
+	return termState, nil
+}
+
+func restoreTerminal(fd int, state *terminal.State) error {
+	return terminal.Restore(fd, state)
+}
+
+// readPassword reads a line from the local terminal without echoing it.
+func readPassword() ([]byte, error) {
+	return terminal.ReadPassword(stdinFd())
+}
+
+// startShell opens an interactive shell on the remote which is wired up to the
+// local terminal.  If `ShellCmd` is set, that command is run with a pty instead
+// of the login shell.  The returned function closes the shell and restores the
+// local terminal.
+func (c *Client) startShell() (func(), error) {
+	if c.target != nil {
+		return c.target.startShell(c.opts.ShellCmd)
+	}
+
+	// Create a new ssh session for use in a `shell`.
+	sess, err := c.newSSHSession()
+	if err != nil {
+		return nil, err
+	}
+
+	ok := false
+	defer func() {
+		if !ok {
+			c.closeSession(sess)
+		}
+	}()
+
+	// Plumbing.
+	sessStdout, err := sess.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	sessStderr, err := sess.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+	sessStdin, err := sess.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	localStdin := stdinReader // keeps anything typed ahead of a prompt's answer
+	// Status messages drawn in place are cleared before the shell writes.
+	localStdout, localStderr := stdoutStatus.writer(os.Stdout), stdoutStatus.writer(os.Stderr)
+	go io.Copy(localStdout, sessStdout) // session Stdout -> local Stdout
+	go io.Copy(localStderr, sessStderr) // session Stderr -> local Stderr
+	go io.Copy(sessStdin, localStdin)   // local Stdin -> session Stdin
+
+	/*
+	 *  Setup the terminal in raw mode and request the appropriate h x w.
+	 */
+	fd := stdinFd()
+	oldState, err := setupTerminalForSession(fd, stdoutFd(), sess, c.opts.TTYEcho)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(c.opts.ShellCmd) > 0 {
+		err = sess.Start(c.opts.ShellCmd)
+	} else {
+		err = sess.Shell()
+	}
+	if err != nil {
+		restoreTerminal(fd, oldState)
+		return nil, err
+	}
+
+	// Keep the remote pty the same size as the local terminal.
+	stopResize := watchWindowSize(stdoutFd(), sess)
+
+	ok = true
+	return func() {
+		stopResize()
+		restoreTerminal(fd, oldState)
+		c.closeSession(sess)
+	}, nil
+}
+
+// StartShell creates a new ssh session and opens a shell to the remote address.
+// It also hooks up the standard input / output pipes to allow terminal access
+// which can be blocked by updates to subscribed files made in the local path.
+// It returns once the client is closed.
+func (c *Client) StartShell(skipInitialSync bool) error {
+	return c.run(skipInitialSync, true)
+}
+
+// Watch subscribes to the local directory and syncs changes to the remote
+// like `StartShell`, but without opening a shell or touching the terminal.  It
+// returns once the client is closed.
+func (c *Client) Watch(skipInitialSync bool) error {
+	return c.run(skipInitialSync, false)
+}
+
+// EventHandler is called by `WatchWithHandler` for each change to the local
+// directory.
+type EventHandler func(notify.EventInfo) error
+
+// WatchWithHandler subscribes to `dir`, or the local directory if it is empty,
+// and calls `fn` for each change until the client is closed, in place of the
+// built-in sync.  Changes to ignored paths are dropped first, and errors from
+// `fn` are reported and counted towards `Failures` like failed syncs.  The
+// built-in sync of a single event is `HandleEvent`, which `fn` may call to add
+// to the sync rather than replace it.  There is no initial sync, debouncing or
+// pairing of renames, see `Watch` for those.
+func (c *Client) WatchWithHandler(dir string, fn EventHandler) error {
+	c.loopLock.Lock()
+	if err := c.ctx.Err(); err != nil {
+		c.loopLock.Unlock()
+		return err
+	}
+	c.loop.Add(1)
+	c.loopLock.Unlock()
+	defer c.loop.Done()
+
+	if len(dir) == 0 {
+		dir = c.localDir
+	}
+	if c.recursive {
+		dir = path.Join(dir, "...")
+	}
+	if err := c.SubscribeDir(dir); err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case <-c.ctx.Done():
+			return nil
+		case evt := <-c.events:
+			if evt.Event() == notify.Create {
+				c.followNewDir(evt.Path())
+			}
+			if c.ignored(evt.Path()) {
+				continue
+			}
+			if err := fn(evt); err != nil {
+				c.syncError(evt.Path(), err)
+			}
+		}
+	}
+}
+
+// run subscribes to the local directory and syncs changes to the remote until
+// the client is closed, with a shell open on the remote if `shell` is set.
+func (c *Client) run(skipInitialSync, shell bool) error {
+	c.loopLock.Lock()
+	if err := c.ctx.Err(); err != nil {
+		c.loopLock.Unlock()
+		return err
+	}
+	c.loop.Add(1)
+	c.loopLock.Unlock()
+	defer c.loop.Done()
+
+	// Subscribe to all changes in the local directory.
+	dir := c.localDir
+	if c.recursive {
+		dir = path.Join(dir, "...")
+	}
+	if err := c.SubscribeDir(dir); err != nil {
+		return err
+	}
+
+	// Changes are synced in parallel, but in order for related paths, along
+	// with the files of the initial sync, see `dispatcher`.
+	disp := newDispatcher(c.opts.SyncWorkers, c.handleEvent, c.afterChange)
+	defer disp.wait()
+
+	// With `SyncFirst` the remote tree is complete before the shell starts,
+	// otherwise the initial sync happens while the shell is already in use.
+	syncFirst := c.opts.SyncFirst && !skipInitialSync
+	if syncFirst {
+		if err := c.initialSync(disp); err != nil {
+			return err
+		}
+	}
+
+	closeShell := func() {}
+	if shell {
+		var err error
+		if closeShell, err = c.startShell(); err != nil {
+			return err
+		}
+	}
+	defer func() { closeShell() }()
+
+	// Only do the initial sync if the `skipInitialSync` is not set.  It runs
+	// alongside the event loop below, so that changes made while the tree
+	// is being walked are not lost.  Changes to a file while it is being
+	// transferred cause a single follow-up transfer, see `inFlight`.
+	var synced chan error
+	if !skipInitialSync && !syncFirst {
+		synced = make(chan error, 1)
+		go func() { synced <- c.initialSync(disp) }()
+		defer func() {
+			if synced != nil {
+				<-synced
+			}
+		}()
+	}
+
+	// Continue syncing any changes from here on out.  Events are held for
+	// the `Debounce` window so that a burst of writes syncs the file once.
+	// While the connection is down events are queued in the debouncer, and
+	// synced once it is back.
+	deb := newDebouncer(c.opts.Debounce)
+	defer deb.stop()
+	renames := &renamePairer{}
+	defer renames.stop()
+	idle := &idleTimer{timeout: c.opts.IdleTimeout}
+	defer idle.stop()
+	if synced == nil {
+		idle.start()
+	}
+	gen := c.generation()
+	var down <-chan struct{}
+	dispatch := func(p string, e notify.Event) {
+		if c.opts.Debounce <= 0 && down == nil {
+			disp.add(p, e)
+		} else {
+			deb.add(p, e)
+		}
+	}
+	for {
+		down = c.reconnecting()
+		due := deb.C()
+		if down != nil {
+			due = nil
+		}
+
+		select {
+		case <-c.ctx.Done():
+			return nil
+		case <-down:
+		case err := <-synced:
+			if err != nil {
+				return err
+			}
+			synced = nil
+			idle.start()
+		case <-idle.C():
+			c.status(fmt.Sprintf("No changes for %s, stopping", c.opts.IdleTimeout))
+			c.fail(ErrIdleTimeout)
+			return nil
+		case evt := <-c.events:
+			if evt.Event() == notify.Create {
+				c.followNewDir(evt.Path())
+			}
+			if c.ignored(evt.Path()) {
+				continue
+			}
+			idle.reset()
+
+			// Pair the two sides of a rename, see `renamePairer`.  While
+			// the connection is down both sides are queued as they are.
+			if down == nil && renames.hold(evt.Path(), evt.Event()) {
+				continue
+			}
+			dispatch(evt.Path(), evt.Event())
+		case <-renames.C():
+			olds, news := renames.take()
+			if down == nil {
+				c.dispatchRenames(disp, olds, news)
+			} else {
+				// Without a connection to compare with, both sides are
+				// queued as they are.
+				for _, p := range olds {
+					dispatch(p, notify.Rename)
+				}
+				for _, pe := range news {
+					dispatch(pe.path, pe.event)
+				}
+			}
+		case <-due:
+			for _, pe := range deb.due() {
+				disp.add(pe.path, pe.event)
+			}
+		}
+
+		// The shell went away with the old connection, open a new one.
+		if g := c.generation(); g != gen && shell {
+			gen = g
+			closeShell()
+			var err error
+			if closeShell, err = c.startShell(); err != nil {
+				closeShell = func() {}
+				return err
+			}
+		}
+	}
+}
+
+// handleEvent syncs the change `event` to the local `path` to the remote.
+func (c *Client) handleEvent(path string, event notify.Event) {
+	if err := c.HandleEvent(pendingEvent{path: path, event: event}); err != nil {
+		c.syncError(path, err)
+	}
+}
+
+// HandleEvent syncs the change `evt` to the remote, the built-in handler for
+// `WatchWithHandler`.  The result is logged, but it is left to the caller to
+// report an error.
+func (c *Client) HandleEvent(evt notify.EventInfo) error {
+	start, path, event := time.Now(), evt.Path(), evt.Event()
+
+	var name string
+	var err error
+	switch event {
+	case notify.Create:
+		name = "create"
+		c.textStatus(fmt.Sprintf("create :: %s", path))
+		if fi, serr := os.Stat(path); serr == nil && fi.IsDir() {
+			err = c.remoteCreateDir(path)
+		} else {
+			err = c.remoteCreateFile(path)
+		}
+	case notify.Remove:
+		name = "remove"
+		c.textStatus(fmt.Sprintf("remove :: %s", path))
+		err = c.remoteRemoveFile(path)
+	case notify.Write:
+		name = "write"
+		c.textStatus(fmt.Sprintf("write  :: %s", path))
+		err = c.remoteUpdateFile(path)
+	case notify.Rename:
+		name = "rename"
+		c.textStatus(fmt.Sprintf("rename :: %s", path))
+		err = c.remoteRenameFile(path)
+	default:
+		name = fmt.Sprintf("unknown (%d)", event)
+		c.textStatus(fmt.Sprintf("unknown (%d) :: %s", event, path))
+	}
+
+	remotePath, _ := c.remotePathFor(path)
+	c.logResult(name, path, remotePath, 0, start, err)
+	return err
+}
+
+// localFiles walks the local directory and recurses subdirs if the client is
+// recursive.  It returns the list of files to sync.
+func (c *Client) localFiles() ([]string, error) {
+	files, _, err := c.localTree()
+	return files, err
+}
+
+// localTree is `localFiles`, which also returns the subdirectories of the
+// local directory with nothing to sync inside them.  These are not created on
+// the remote as the parent of any file, so they are created on their own.
+func (c *Client) localTree() ([]string, []string, error) {
+	if len(c.localFile) > 0 {
+		return []string{c.localFile}, nil, nil
+	}
+
+	files, dirs := []string{}, []string{}
+	nonEmpty := map[string]bool{}
+	if err := c.walkLocal(c.localDir, func(path string, f os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if f.IsDir() && path != c.localDir && (!c.recursive || c.hidden(path)) {
+			return filepath.SkipDir
+		}
+
+		// Ignore hidden files, see `hidden`.
+		// TODO: Ignore files on the blacklist.
+		if path == c.localDir || c.ignored(path) {
+			return nil
+		}
+		nonEmpty[filepath.Dir(path)] = true
+		if f.IsDir() {
+			dirs = append(dirs, path)
+		} else {
+			files = append(files, path)
+		}
+		return nil
+	}); err != nil {
+		return nil, nil, err
+	}
+
+	empty := []string{}
+	for _, d := range dirs {
+		if !nonEmpty[d] {
+			empty = append(empty, d)
+		}
+	}
+	return files, empty, nil
+}
+
+// initialSync pushes every local file to the remote through `disp`, see
+// `syncTree`.  Files which fail to transfer are reported but do not stop the
+// sync.
+func (c *Client) initialSync(disp *dispatcher) error {
+	failed, err := c.syncTree(disp)
+	if err != nil || len(c.opts.PostCmd) == 0 {
+		return err
+	}
+	if failed > 0 {
+		c.status(fmt.Sprintf("Skipping post-cmd, %d files failed to sync", failed))
+	} else if err := c.runPostCmd(); err != nil {
+		c.syncError("post-cmd", err)
+	}
+	return nil
+}
+
+// SyncOnce pushes every local file to the remote without starting a shell or
+// watching for changes.  Unlike the initial sync of `StartShell`, it fails if
+// any file could not be transferred, or if `PostCmd` fails.
+func (c *Client) SyncOnce() error {
+	failed, err := c.syncTree(newDispatcher(c.opts.SyncWorkers, c.handleEvent, nil))
+	if err != nil {
+		return err
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d files failed to sync", failed)
+	}
+	if len(c.opts.PostCmd) > 0 {
+		if err := c.runPostCmd(); err != nil {
+			return fmt.Errorf("post-cmd: %s", err.Error())
+		}
+	}
+	return nil
+}
+
+// syncTree pushes every local file to the remote and returns the number of
+// files which failed to transfer.  Files are sent as jobs on `disp`, so that
+// events for a file which arrive meanwhile wait for its transfer rather than
+// racing it.  When the `Marker` option is set, the sync is skipped entirely if
+// the remote tree is known to match the local one.
+func (c *Client) syncTree(disp *dispatcher) (int, error) {
+	files, dirs, err := c.localTree()
+	if err != nil {
+		return 0, err
+	}
+
+	treeHash := ""
+	if c.opts.Marker {
+		treeHash, err = c.localTreeHash(files)
+		if err != nil {
+			return 0, err
+		}
+		if c.remoteMarker() == treeHash {
+			c.status("Remote marker matches local tree, skipping initial sync")
+			return 0, nil
+		}
+	}
+
+	// Sync local files to remote
+	c.status(fmt.Sprintf("Initial sync of %d files", len(files)))
+	c.loadRemoteSums(files)
+	defer c.sums.save()
+
+	// Files are synced by the dispatcher's `SyncWorkers` goroutines, the
+	// number of sessions open at once is still bounded by `MaxSessions`.
+	// Only a few more files than there are workers are queued at a time,
+	// which keeps the dispatcher's queue short.
+	var failures int32
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, 2*c.opts.SyncWorkers)
+	for _, f := range files {
+		if c.ctx.Err() != nil {
+			break
+		}
+		slots <- struct{}{}
+
+		absLocal, err := filepath.Abs(f)
+		if err != nil {
+			absLocal = f
+		}
+		wg.Add(1)
+		disp.do([]string{absLocal}, func() {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+			absDst, err := c.remotePathFor(absLocal)
+			if err == nil {
+				err = c.syncLocalFileToRemote(absLocal, absDst)
+			}
+			if err != nil {
+				c.syncError(absLocal, err)
+				atomic.AddInt32(&failures, 1)
+			}
+		})
+	}
+	wg.Wait()
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	failed := int(failures)
+	c.status(fmt.Sprintf("Initial sync complete, %d of %d files synced", len(files)-failed, len(files)))
+	failed += c.syncEmptyDirs(dirs)
+	failed += c.pruneOrphans(files)
+
+	if len(c.opts.Manifest) > 0 {
+		if err := c.writeManifest(); err != nil {
+			return failed, err
+		}
+	}
+
+	// Only record the marker when everything made it across, otherwise the
+	// next run would skip files which are missing on the remote.
+	if c.opts.Marker && failed == 0 {
+		return 0, c.writeRemoteMarker(treeHash)
+	}
+	return failed, nil
+}
+
+// syncEmptyDirs creates the local directories `dirs`, which have nothing to
+// sync inside them, on the remote so that its tree matches the local one.  It
+// returns the number which could not be created.
+func (c *Client) syncEmptyDirs(dirs []string) int {
+	failed := 0
+	for _, d := range dirs {
+		if c.ctx.Err() != nil {
+			break
+		}
+		remotePath, err := c.remotePathFor(d)
+		if err == nil {
+			if !c.opts.DryRun {
+				c.textStatus(fmt.Sprintf("Create dir: %s", remotePath))
+			}
+			err = c.makeRemoteDir(remotePath)
+		}
+		if err != nil {
+			c.syncError(d, err)
+			failed++
+		}
+	}
+	return failed
+}
+
+// remoteRemoveFile is fired when the tracked file residing at `localPath` is
+// removed.
+func (c *Client) remoteRemoveFile(localPath string) error {
+	remotePath, err := c.remotePathFor(localPath)
+	if err != nil {
+		return err
+	}
+	return c.removeRemotePath(remotePath)
+}
+
+// removeRemotePath removes the remote file at `remotePath`, and succeeds if it
+// is already gone.
+func (c *Client) removeRemotePath(remotePath string) error {
+	if c.opts.DryRun {
+		c.status(fmt.Sprintf("[dry-run] remove %s", remotePath))
+		return nil
+	}
+
+	// Once it is gone a new file of the same contents must be sent again.
+	defer c.forgetRemoteSum(remotePath)
+
+	if sc := c.sftpSession(); sc != nil {
+		if err := sc.Remove(remotePath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	return c.runRemoteCommand(c.shell.remove(remotePath))
+}
+
+// remoteRenameFile is fired when the tracked file residing at `localPath` is
+// renamed, and the other side of the rename could not be found (see
+// `renamePairer`).  If nothing exists at `localPath` anymore it was the old name
+// and is removed from the remote, otherwise it is the new name (ex: an editor
+// renaming its temp file over the original on save) and is synced.
+func (c *Client) remoteRenameFile(localPath string) error {
+	if _, err := os.Lstat(localPath); os.IsNotExist(err) {
+		return c.remoteRemoveFile(localPath)
+	}
+	return c.remoteUpdateFile(localPath)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// session is the subset of `*ssh.Session` used to run commands on the remote.
+// It allows targets other than ssh to reuse the same transfer logic.
+type session interface {
+	StdinPipe() (io.WriteCloser, error)
+	StdoutPipe() (io.Reader, error)
+	StderrPipe() (io.Reader, error)
+	Start(cmd string) error
+	Wait() error
+	Run(cmd string) error
+	Output(cmd string) ([]byte, error)
+	Close() error
+}
+
+// newSSHSession opens a new ssh session on the underlying connection, blocking
+// while `MaxSessions` sessions are already in use.  Sessions returned from
+// here must be released with `closeSession`.
+func (c *Client) newSSHSession() (*ssh.Session, error) {
+	c.sessions <- struct{}{}
+	sess, err := c.conn().NewSession()
+	if err != nil {
+		<-c.sessions
+		return nil, err
+	}
+	return sess, nil
+}
+
+// newSession opens a new session to the remote, which is either an ssh session
+// or a command run in a container depending on the target.  Sessions returned
+// from here must be released with `closeSession`.
+func (c *Client) newSession() (session, error) {
+	if c.target != nil {
+		c.sessions <- struct{}{}
+		return c.target.newSession(), nil
+	}
+	return c.newSSHSession()
+}
+
+// closeOnCancel closes `sess` if `ctx` is cancelled before the returned
+// function is called, which unblocks anything reading from or writing to it.
+func closeOnCancel(ctx context.Context, sess session) func() {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			sess.Close()
+		case <-done:
+		}
+	}()
+	return func() { close(done) }
+}
+
+// closeSession closes `sess` and frees its slot for another session.
+func (c *Client) closeSession(sess session) {
+	sess.Close()
+	<-c.sessions
+}
+
+// RunCapture runs `cmd` on the remote and returns its stdout, stderr and exit
+// code.  A non-zero exit code is not an error, `err` is only set if the command
+// could not be run at all, in which case it is retried up to `CommandRetries`
+// times.  Cancelling `ctx` closes the session and returns `ctx.Err()`.
+func (c *Client) RunCapture(ctx context.Context, cmd string) (stdout, stderr string, exitCode int, err error) {
+	for attempt := 0; attempt <= c.opts.CommandRetries; attempt++ {
+		stdout, stderr, exitCode, err = c.runCapture(ctx, cmd)
+		if err == nil || ctx.Err() != nil {
+			break
+		}
+	}
+	return stdout, stderr, exitCode, err
+}
+
+// runCapture is a single attempt of `RunCapture`.
+func (c *Client) runCapture(ctx context.Context, cmd string) (string, string, int, error) {
+	sess, err := c.newSession()
+	if err != nil {
+		return "", "", -1, err
+	}
+	defer c.closeSession(sess)
+
+	sessStdout, err := sess.StdoutPipe()
+	if err != nil {
+		return "", "", -1, err
+	}
+	sessStderr, err := sess.StderrPipe()
+	if err != nil {
+		return "", "", -1, err
+	}
+	if err := sess.Start(cmd); err != nil {
+		return "", "", -1, err
+	}
+
+	var stdout, stderr bytes.Buffer
+	done := make(chan error, 1)
+	go func() {
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() { io.Copy(&stdout, sessStdout); wg.Done() }()
+		go func() { io.Copy(&stderr, sessStderr); wg.Done() }()
+		wg.Wait()
+		done <- sess.Wait()
+	}()
+
+	select {
+	case <-ctx.Done():
+		sess.Close()
+		return "", "", -1, ctx.Err()
+	case err = <-done:
+	}
+
+	if code, ok := exitStatus(err); ok {
+		return stdout.String(), stderr.String(), code, nil
+	}
+	return stdout.String(), stderr.String(), -1, err
+}
+
+// exitStatus returns the exit code of a remote command given the error from
+// waiting on it.  It returns false if the command did not run to completion.
+func exitStatus(err error) (int, bool) {
+	switch e := err.(type) {
+	case nil:
+		return 0, true
+	case *ssh.ExitError:
+		return e.ExitStatus(), true
+	case *exec.ExitError:
+		return e.ExitCode(), true
+	}
+	return -1, false
+}
+
+// shellQuote quotes `s` so that it is passed as a single literal argument when
+// interpolated into a command run by a POSIX shell.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// runRemoteCommand runs `cmd` on the remote, a non-zero exit is an error.
+func (c *Client) runRemoteCommand(cmd string) error {
+	_, err := c.runRemoteCommandOutput(cmd)
+	return err
+}
+
+// runRemoteCommandOutput runs `cmd` on the remote and returns its stdout.  A
+// non-zero exit is returned as an error which includes the command's stderr.
+func (c *Client) runRemoteCommandOutput(cmd string) ([]byte, error) {
+	stdout, stderr, code, err := c.RunCapture(context.Background(), cmd)
+	if err == nil && code != 0 {
+		err = fmt.Errorf("remote command exited with status %d: %s", code, strings.TrimSpace(stderr))
+	}
+	return []byte(stdout), err
+}
+
+// Runs a `mkdir -p` for the given path to ensure that the other end has a
+// valid directory at the specified `path`.
+func (c *Client) ensureRemoteDirectory(path string) error {
+	return c.makeRemoteDir(filepath.Dir(path))
+}
+
+// makeRemoteDir creates the remote directory `dir` and any missing parents.
+func (c *Client) makeRemoteDir(dir string) error {
+	if c.opts.DryRun {
+		c.status(fmt.Sprintf("[dry-run] mkdir %s", dir))
+		return nil
+	}
+	if sc := c.sftpSession(); sc != nil {
+		return sc.MkdirAll(dir)
+	}
+	return c.runRemoteCommand(c.shell.mkdirAll(dir))
+}
+
+// readAck reads a single scp acknowledgement from `r`.  The sink sends a zero
+// byte each time it is ready for the next part of the transfer.  A status of 1
+// (warning) or 2 (fatal) is followed by a newline terminated error message
+// which is returned as an error.
+func readAck(r io.Reader) error {
+	var b [1]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return err
+	}
+
+	switch status := b[0]; status {
+	case 0:
+		return nil
+	case 1, 2:
+		msg := []byte{}
+		for {
+			if _, err := io.ReadFull(r, b[:]); err != nil || b[0] == '\n' {
+				break
+			}
+			msg = append(msg, b[0])
+		}
+		return fmt.Errorf("remote: %s", msg)
+	default:
+		return fmt.Errorf("scp: unexpected acknowledgement %#x", status)
+	}
+}
+
+// copy creates a new session using the underlying ssh connection and copies
+// the contents from the source reader into the destination path specified by
+// `dstpath`.  The file's permissions and size are expected.
+//
+// The scp sink acknowledges each step of the transfer: once when it starts,
+// once after the `C` header, and once after the file contents.  We wait for
+// each of these before moving on so that strict receivers do not see data
+// before they are ready for it.
+func (c *Client) copy(ctx context.Context, src io.Reader, dstpath, perms string, sz int64) error {
+	sess, err := c.newSession()
+	if err != nil {
+		return err
+	}
+	defer c.closeSession(sess)
+	defer closeOnCancel(ctx, sess)()
+
+	file := path.Base(dstpath)
+	dirp := path.Dir(dstpath)
+
+	dst, err := sess.StdinPipe()
+	if err != nil {
+		return err
+	}
+	ack, err := sess.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	stderr, err := sess.StderrPipe()
+	if err != nil {
+		return err
+	}
+	var remoteErr bytes.Buffer
+	stderrDone := make(chan struct{})
+	go func() {
+		io.Copy(&remoteErr, stderr)
+		close(stderrDone)
+	}()
+
+	scp := c.opts.SCPPath
+	if len(scp) == 0 {
+		scp = DefaultSCPPath
+	}
+	if err := sess.Start(c.shell.scpSink(scp, dirp)); err != nil {
+		return err
+	}
+
+	err = func() error {
+		defer dst.Close()
+
+		if err := readAck(ack); err != nil {
+			return err
+		}
+
+		fmt.Fprintf(dst, "C%s %d %s\n", perms, sz, file)
+		if err := readAck(ack); err != nil {
+			return err
+		}
+
+		// Only send the advertised number of bytes, if the file grew since we
+		// looked at its size the rest will be picked up by the next sync.
+		// If it shrank, give up rather than leave the sink waiting for bytes
+		// which will never arrive.
+		if n, err := io.CopyN(dst, src, sz); err == io.EOF {
+			return fmt.Errorf("short read, sent %d of %d bytes for %s", n, sz, dstpath)
+		} else if err != nil {
+			return err
+		}
+		fmt.Fprintf(dst, "\x00")
+		return readAck(ack)
+	}()
+
+	// An early EOF means the sink exited, whose exit status says more.
+	werr := sess.Wait()
+	<-stderrDone
+	if err == nil || (err == io.EOF && werr != nil) {
+		err = werr
+	}
+	if err == nil {
+		return nil
+	} else if ctx.Err() != nil {
+		return ctx.Err()
+	}
 
-	base := path.Join(u.HomeDir, ".ssh")
-	for _, k := range []string{"id_rsa", "id_dsa"} {
-		pkf := path.Join(base, k)
-		fmt.Printf("PKF=%s\n", pkf)
-		if _, err := os.Stat(pkf); err == nil {
-			bs, err := ioutil.ReadFile(pkf)
-			if err != nil {
-				return nil, err
-			}
+	// The shell exits with 127 when it cannot find the command.
+	if code, ok := exitStatus(werr); ok && code == 127 {
+		return fmt.Errorf("scp not found on the remote at %q, see -scp-path", scp)
+	}
+	return withRemoteStderr(err, remoteErr.String())
+}
 
-			k, err := ssh.ParsePrivateKey(bs)
-			if err != nil {
-				return nil, err
-			}
+// withRemoteStderr adds what the remote command printed to stderr to `err`,
+// which otherwise rarely says why the command failed.
+func withRemoteStderr(err error, stderr string) error {
+	msg := strings.Join(strings.Fields(strings.Replace(strings.TrimSpace(stderr), "\n", "; ", -1)), " ")
+	if len(msg) == 0 || strings.Contains(err.Error(), msg) {
+		return err
+	}
+	return fmt.Errorf("remote: %s (%s)", msg, err.Error())
+}
 
-			// TODO: Handle if there is a passphrase.
-			// https: //github.com/golang/crypto/blob/master/ssh/agent/keyring.go
+// upload writes `sz` bytes from `src` to `dstpath` with the `transferer`
+// selected by `Transfer`.  The file is replaced atomically,
+// see `writeAtomic`.
+func (c *Client) upload(src io.Reader, dstpath, perms string, sz int64) error {
+	src, done := c.withProgress(c.throttle(src), dstpath, sz)
+	defer done()
 
-			ret = append(ret, ssh.PublicKeys(k))
-		}
+	mode, err := strconv.ParseUint(perms, 8, 32)
+	if err != nil {
+		return fmt.Errorf("invalid permissions %q: %s", perms, err.Error())
 	}
-	return ret, nil
+	return c.writeAtomic(dstpath, sz, func(dst string) error {
+		return c.transferer().Upload(src, dst, os.FileMode(mode), sz)
+	})
 }
 
-////////////////////////////////////////////////////////////////////////////////
+// setRemoteModTime sets the modification time of `remote` to `mtime`, so that
+// build tools on the remote do not consider every synced file to be new.  Like
+// `rsync -t`, the access time is left as the time of the transfer.
+func (c *Client) setRemoteModTime(remote string, mtime time.Time) error {
+	if sc := c.sftpSession(); sc != nil {
+		return sc.Chtimes(remote, time.Now(), mtime)
+	}
+	return c.runRemoteCommand(c.shell.touch(remote, mtime))
+}
 
-const isRecursiveWatch = true
+// Copies the contents of an os.File to a remote location, it will get the length of the file by looking it up from the filesystem
+func (c *Client) copyFromFile(file os.File, remotePath string, perms string) error {
+	stat, _ := file.Stat()
+	return c.upload(&file, remotePath, perms, stat.Size())
+}
 
-////////////////////////////////////////////////////////////////////////////////
+// syncLocalFileToRemote syncs the local file `local` to `remote`, where both
+// are absolute paths.  If `remote` is already being synced, this returns at
+// once and the file is synced again after the running sync completes, so that
+// any number of changes during a transfer cause a single follow-up transfer.
+func (c *Client) syncLocalFileToRemote(local, remote string) error {
+	if !c.inFlight.start(remote) {
+		c.textStatus(fmt.Sprintf("In flight, queued: %s", local))
+		return nil
+	}
+	for {
+		err := c.syncFile(local, remote)
+		if !c.inFlight.done(remote) {
+			return err
+		}
+	}
+}
 
-// Client wraps a `ssh.Client` which can monitor the file system for changes.
-type Client struct {
-	*ssh.Client // Client `is-a` *ssh.Client
+// syncFile syncs two files where both local and remote are absolute paths,
+// see `syncLocalFileToRemote`.
+func (c *Client) syncFile(local, remote string) (err error) {
+	c.openFiles <- struct{}{}
+	defer func() { <-c.openFiles }()
 
-	config *ssh.ClientConfig     // ssh connection config
-	events chan notify.EventInfo // events channel for watched changes
+	start, event, sz := time.Now(), "sync", int64(0)
+	defer func() { c.logResult(event, local, remote, sz, start, err) }()
 
-	localDir  string // Local directory to keep in sync
-	remoteDir string // Remote directory to push files to
-}
+	if fi, err := os.Lstat(local); err == nil && isSymlink(fi) {
+		switch c.opts.Symlinks {
+		case SymlinksSkip:
+			event = "skipped"
+			return nil
+		case SymlinksCopy:
+			event = "link"
+			return c.remoteSymlink(local, remote)
+		}
+	}
 
-// New returns a ssh client which can watch files for changes.
-func New(addr, localDir string) (*Client, error) {
-	ssha, err := sshaddr.Parse(addr)
+	// Files are often gone by the time they are synced, for example the
+	// temporary files of a build, which is not an error.
+	f_local, err := os.Open(local)
+	if os.IsNotExist(err) {
+		event = "vanished"
+		c.textStatus(fmt.Sprintf("Vanished, skipping: %s", local))
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f_local.Close()
+	stat, err := f_local.Stat()
 	if err != nil {
-		return nil, err
+		return err
+	}
+	sz = stat.Size()
+	if c.opts.MaxFileSize > 0 && sz > c.opts.MaxFileSize {
+		event = "skipped"
+		c.status(fmt.Sprintf("Warning: skipping %s, its %d bytes are over the maximum of %d", local, sz, c.opts.MaxFileSize))
+		return nil
 	}
 
-	host, port := ssha.Host(), ssha.Port()
-	user, pass, auth := ssha.User(), ssha.Pass(), []ssh.AuthMethod{}
-
-	if len(pass) == 0 {
-		// No pass specified - check for cert based auth.
-		cert_auths, err := checkForUserCertAuth(user)
-		if err != nil {
-			return nil, err
-		} else if len(cert_auths) > 0 {
-			auth = append(auth, cert_auths...)
+	same, sum := c.unchanged(f_local, local, remote)
+	perms := c.remotePerms(local, stat)
+	modeStale := same && c.remoteModeStale(remote, perms)
+	timeStale := same && !c.opts.NoTimes && c.remoteTimeStale(remote, stat.ModTime())
+	if modeStale || timeStale {
+		// Only the permissions or modification time changed, for example
+		// after a `chmod` or `touch`, so there is no need to send the
+		// contents again.
+		event = "times"
+		if modeStale {
+			event = "mode"
 		}
-
-		// Password not specified and the key files are missing, prompt
-		// the shell for a password.
-		if len(auth) == 0 {
-			fmt.Printf("%s@%s's password: ", user, host)
-			bs, err := terminal.ReadPassword(int(syscall.Stdin))
-			if err != nil {
-				return nil, err
+		if c.opts.DryRun {
+			c.textStatus(fmt.Sprintf("[dry-run] set %s of %s", event, remote))
+			return nil
+		}
+		if modeStale {
+			c.textStatus(fmt.Sprintf("Mode %s: %s --> %s", perms, local, remote))
+			if err := c.setRemoteMode(remote, perms); err != nil {
+				return err
+			}
+			c.recordRemoteMode(remote, perms)
+		}
+		if timeStale {
+			c.textStatus(fmt.Sprintf("Times: %s --> %s", local, remote))
+			if err := c.setRemoteModTime(remote, stat.ModTime()); err != nil {
+				return err
 			}
-			fmt.Printf("\n")
-			auth = append(auth, ssh.Password(string(bs)))
+			c.recordRemoteTime(remote, stat.ModTime())
 		}
+	} else if same {
+		event = "unchanged"
+		c.textStatus(fmt.Sprintf("Unchanged: %s", local))
+	} else if c.opts.DryRun {
+		event = "dry-run"
+		c.textStatus(fmt.Sprintf("[dry-run] sync %s --> %s", local, remote))
+		return nil
 	} else {
-		auth = append(auth, ssh.Password(pass))
+		status := fmt.Sprintf("Sync file: %s --> %s", local, remote)
+		c.textStatus(status)
+		err := c.withTransferRetries(local, func() error {
+			if _, err := f_local.Seek(0, io.SeekStart); err != nil {
+				return err
+			}
+			if err := c.ensureRemoteDirectory(remote); err != nil {
+				return err
+			}
+			if err := c.transferFile(f_local, local, remote); err != nil {
+				return err
+			}
+			if !c.opts.NoTimes {
+				return c.setRemoteModTime(remote, stat.ModTime())
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		c.recordRemoteSum(remote, sum)
+		c.recordRemoteMode(remote, perms)
+		if !c.opts.NoTimes {
+			c.recordRemoteTime(remote, stat.ModTime())
+		}
 	}
 
-	config := &ssh.ClientConfig{
-		User:            user,
-		Auth:            auth,
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	if len(c.opts.Manifest) > 0 {
+		return c.recordManifest(f_local, local, remote)
 	}
+	return nil
+}
 
-	client, err := ssh.Dial("tcp", fmt.Sprintf("%s:%d", host, port), config)
+// transferFile sends the contents of the local file `f` to `remote` using the
+// transfer method selected by the client's options.
+func (c *Client) transferFile(f *os.File, local, remote string) error {
+	stat, err := f.Stat()
 	if err != nil {
-		return nil, err
+		return err
 	}
+	perms := c.remotePerms(local, stat)
 
-	fmt.Printf("Connected!\n")
+	if fn := c.transformFor(local); fn != nil {
+		r, sz, err := fn(f)
+		if err != nil {
+			return err
+		}
+		return c.upload(r, remote, perms, sz)
+	}
 
-	return &Client{
-		Client: client,
+	if c.opts.Dedup {
+		return c.dedupLocalFileToRemote(f, remote, perms)
+	}
 
-		config: config,
-		events: make(chan notify.EventInfo, 1),
+	if c.opts.Delta {
+		if stat.Size() >= c.opts.DeltaMinSize {
+			if err := c.deltaLocalFileToRemote(f, remote, perms, stat.Size()); err == nil {
+				return nil
+			}
 
-		localDir:  localDir,
-		remoteDir: ssha.Destination(),
-	}, nil
-}
+			// Fall back to a full copy if the remote file could not be
+			// patched, for example if it does not exist yet.
+			if _, err := f.Seek(0, io.SeekStart); err != nil {
+				return err
+			}
+		}
+	}
 
-// Attempt to update status on the same status line  ... wip
-func (c *Client) status(msg string) error {
-	// fmt.Printf("\033[A\033[2K\r")
-	fmt.Printf("\r%s\n", msg)
-	// fmt.Printf(msg + "\n")
-	return nil
-}
+	if c.opts.Compress {
+		if stat.Size() >= c.opts.CompressMinSize {
+			if ok, err := compressible(f); err == nil && ok {
+				if err := c.compressLocalFileToRemote(f, remote, perms, stat.Size()); err == nil {
+					return nil
+				}
 
-func setupTerminalForSession(fd int, sess *ssh.Session) (*terminal.State, error) {
-	modes := ssh.TerminalModes{
-		ssh.ECHO:          1,
-		ssh.TTY_OP_ISPEED: 14400,
-		ssh.TTY_OP_OSPEED: 14400,
+				// Fall back to an uncompressed copy, for example if the
+				// remote has no gzip.
+				if _, err := f.Seek(0, io.SeekStart); err != nil {
+					return err
+				}
+			}
+		}
 	}
+	return c.copyFromFile(*f, remote, perms)
+}
 
-	termState, err := terminal.MakeRaw(fd)
-	if err != nil {
-		return nil, err
-	}
+////////////////////////////////////////////////////////////////////////////////
 
-	w, h, err := terminal.GetSize(fd)
-	if err != nil {
-		return nil, err
+// hashFile returns the hex encoded sha256 of the contents of `f`.  The file is
+// rewound to the start before returning so that it can be copied afterwards.
+func hashFile(f *os.File) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
 	}
-
-	return termState, sess.RequestPty("xterm-256color", h, w, modes)
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
 }
 
-func restoreTerminal(fd int, state *terminal.State) error {
-	return terminal.Restore(fd, state)
-}
+// loadDedupIndex builds the hash -> path index of files which already exist in
+// the remote directory.  This is done lazily the first time it is needed.
+func (c *Client) loadDedupIndex() error {
+	c.dedupLock.Lock()
+	defer c.dedupLock.Unlock()
 
-// StartShell creates a new ssh session and opens a shell to the remote address.
-// It also hooks up the standard input / output pipes to allow terminal access
-// which can be blocked by updates to subscribed files made in the local path.
-func (c *Client) StartShell(skipInitialSync bool) error {
-	// Subscribe to all changes in the local directory.
-	dir := c.localDir
-	if isRecursiveWatch {
-		dir = path.Join(dir, "...")
+	if c.dedupIndex != nil {
+		return nil
 	}
-	c.SubscribeDir(dir)
 
-	// Create a new ssh session for use in a `shell`.
-	sess, err := c.NewSession()
+	// An empty or missing remote directory is not an error, there is just
+	// nothing to link against yet.  Neither is failing to hash it, files are
+	// then copied rather than linked.
+	sums, err := c.remoteChecksums()
 	if err != nil {
-		return err
+		c.status(fmt.Sprintf("Warning: remote checksums unavailable, files will not be deduplicated (%s)", err.Error()))
 	}
-	defer sess.Close()
-
-	// Plumbing.
-	sessStdout, err := sess.StdoutPipe()
-	if err != nil {
-		return err
+	c.dedupIndex = map[string]string{}
+	for p, sum := range sums {
+		c.dedupIndex[sum] = p
 	}
-	sessStderr, err := sess.StderrPipe()
-	if err != nil {
+	return nil
+}
+
+// dedupLocalFileToRemote hardlinks `remote` to an existing remote file with the
+// same contents as `f` if one exists.  If there is no such file, or if linking
+// fails (ex: the files live on different file systems), the file is copied
+// with the permissions `perms`.
+func (c *Client) dedupLocalFileToRemote(f *os.File, remote, perms string) error {
+	if err := c.loadDedupIndex(); err != nil {
 		return err
 	}
-	sessStdin, err := sess.StdinPipe()
+
+	sum, err := hashFile(f)
 	if err != nil {
 		return err
 	}
 
-	localStdin := os.Stdin
-	localStdout, localStderr := os.Stdout, os.Stderr
-	go io.Copy(localStdout, sessStdout) // session Stdout -> local Stdout
-	go io.Copy(localStderr, sessStderr) // session Stderr -> local Stderr
-	go io.Copy(sessStdin, localStdin)   // local Stdin -> session Stdin
+	c.dedupLock.Lock()
+	existing, ok := c.dedupIndex[sum]
+	c.dedupLock.Unlock()
+	if ok {
+		if existing == remote {
+			return nil
+		}
 
-	/*
-	 *  Setup the terminal in raw mode and request the appropriate h x w.
-	 */
-	fd := int(localStdin.Fd())
-	oldState, err := setupTerminalForSession(fd, sess)
-	if err != nil {
-		return err
+		cmd := fmt.Sprintf("ln -f %s %s", shellQuote(existing), shellQuote(remote))
+		if err := c.runRemoteCommand(cmd); err == nil {
+			c.forgetDedupPath(remote)
+			c.status(fmt.Sprintf("Linked file: %s --> %s", existing, remote))
+			return nil
+		}
 	}
-	defer restoreTerminal(fd, oldState)
 
-	if err := sess.Shell(); err != nil {
+	// The destination may be a hardlink created by a previous run, unlink it
+	// so that we do not clobber the contents of the other linked paths.
+	if err := c.runRemoteCommand(fmt.Sprintf("rm -f %s", shellQuote(remote))); err != nil {
+		return err
+	}
+	if err := c.copyFromFile(*f, remote, perms); err != nil {
 		return err
 	}
 
-	// Walk the local directory and recurse subdirs if the isRecursiveWalk is
-	// set to true.  Only do this if the `skipInitialSync` is not set.
-	if !skipInitialSync {
-		files := []string{}
-		if err := filepath.Walk(c.localDir, func(path string, f os.FileInfo, err error) error {
-			// Ignore hidden files and directories.
-			// TODO: Ignore files on the blacklist.
-			if strings.HasPrefix(path, ".") || f.IsDir() {
-				return nil
-			}
-			files = append(files, path)
-			return nil
-		}); err != nil {
-			return err
+	c.forgetDedupPath(remote)
+	c.dedupLock.Lock()
+	c.dedupIndex[sum] = remote
+	c.dedupLock.Unlock()
+	return nil
+}
+
+// localTreeHash returns a hash over the relative path and contents of each of
+// the specified local `files`.
+func (c *Client) localTreeHash(files []string) (string, error) {
+	h := sha256.New()
+	for _, p := range files {
+		rel, err := filepath.Rel(c.localDir, p)
+		if err != nil {
+			rel = p
 		}
 
-		// Sync local files to remote
-		for _, f := range files {
-			dstPath := strings.TrimPrefix(f, filepath.Clean(c.localDir))
-			if dstPath[0] == '/' {
-				dstPath = dstPath[1:]
-			}
-			absLocal, err := filepath.Abs(f)
+		// Copied links are identified by where they point.
+		if fi, err := os.Lstat(p); err == nil && isSymlink(fi) && c.opts.Symlinks == SymlinksCopy {
+			target, err := os.Readlink(p)
 			if err != nil {
-				absLocal = f
+				return "", err
 			}
-			absDst := filepath.Join(c.remoteDir, dstPath)
-			c.syncLocalFileToRemote(absLocal, absDst)
-		}
-	}
-
-	// TODO: We need a way to break out of this :)
-	// Continue syncing any changes from here on out.
-	for evt := range c.events {
-		path := evt.Path()
-		switch evt.Event() {
-		case notify.Create:
-			c.status(fmt.Sprintf("create :: %s", path))
-			c.remoteCreateFile(path)
-		case notify.Remove:
-			c.status(fmt.Sprintf("remove :: %s", path))
-			c.remoteRemoveFile(path)
-		case notify.Write:
-			c.status(fmt.Sprintf("write  :: %s", path))
-			c.remoteUpdateFile(path)
-		case notify.Rename:
-			c.status(fmt.Sprintf("rename :: %s", path))
-			c.remoteRenameFile(path)
-		default:
-			c.status(fmt.Sprintf("unknown (%d) :: %s", evt.Event(), path))
+			fmt.Fprintf(h, "-> %s %s\n", target, filepath.ToSlash(rel))
+			continue
+		}
+
+		f, err := os.Open(p)
+		if err != nil {
+			return "", err
+		}
+		sum, err := hashFile(f)
+		f.Close()
+		if err != nil {
+			return "", err
 		}
+
+		fmt.Fprintf(h, "%s %s\n", sum, filepath.ToSlash(rel))
 	}
-	return nil
+	return hex.EncodeToString(h.Sum(nil)), nil
 }
 
-// remoteRemoveFile is fired when the tracked file residing at `localPath` is
-// removed.
-func (c *Client) remoteRemoveFile(localPath string) error {
-	return fmt.Errorf("remoteRemoveFile not implemented")
+// remoteMarker returns the tree hash stored on the remote, or an empty string
+// if there is no marker.
+func (c *Client) remoteMarker() string {
+	cmd := fmt.Sprintf("cat %s", shellQuote(path.Join(c.remoteDir, markerFile)))
+	out, err := c.runRemoteCommandOutput(cmd)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
 }
 
-// remoteRenameFile is fired when the tracked file residing at `localPath` is
-// renamed.
-func (c *Client) remoteRenameFile(localPath string) error {
-	return fmt.Errorf("remoteRenameFile not implemented")
+// writeRemoteMarker stores `treeHash` as the remote marker.
+func (c *Client) writeRemoteMarker(treeHash string) error {
+	if c.opts.DryRun {
+		return nil
+	}
+	remote := path.Join(c.remoteDir, markerFile)
+	if err := c.ensureRemoteDirectory(remote); err != nil {
+		return err
+	}
+	return c.upload(strings.NewReader(treeHash), remote, "0644", int64(len(treeHash)))
 }
 
-////////////////////////////////////////////////////////////////////////////////
+// forgetDedupPath drops any index entries which point at `remote` since its
+// contents are about to change.
+func (c *Client) forgetDedupPath(remote string) {
+	c.dedupLock.Lock()
+	defer c.dedupLock.Unlock()
 
-// runRemoteCommand runs
-func (c *Client) runRemoteCommand(cmd string) error {
-	sess, err := c.NewSession()
-	if err != nil {
-		return err
+	for sum, p := range c.dedupIndex {
+		if p == remote {
+			delete(c.dedupIndex, sum)
+		}
 	}
-	defer sess.Close()
-
-	return sess.Run(cmd)
 }
 
-// Runs a `mkdir -p` for the given path to ensure that the other end has a
-// valid directory at the specified `path`.
-func (c *Client) ensureRemoteDirectory(path string) error {
-	cmd := fmt.Sprintf("mkdir -p %s", filepath.Dir(path))
-	return c.runRemoteCommand(cmd)
+// remoteUpdateFile is fired when the tracked file residing at `localPath` is
+// updated.
+func (c *Client) remoteUpdateFile(localPath string) error {
+	remotePath, err := c.remotePathFor(localPath)
+	if err != nil {
+		return err
+	}
+	return c.syncLocalFileToRemote(localPath, remotePath)
 }
 
-// copy creates a new session using the underlying ssh connection and copies
-// the contents from the source reader into the destination path specified by
-// `dstpath`.  The file's permissions and size are expected.
-func (c *Client) copy(src io.Reader, dstpath, perms string, sz int64) error {
-	sess, err := c.NewSession()
+// remotePathFor maps the absolute `localPath` to its path on the remote, see
+// `remoteRel`.
+func (c *Client) remotePathFor(localPath string) (string, error) {
+	localDir, err := filepath.Abs(c.localDir)
 	if err != nil {
-		return err
+		return "", err
 	}
-	defer sess.Close()
 
-	file := path.Base(dstpath)
-	dirp := path.Dir(dstpath)
+	addedPath := strings.TrimPrefix(localPath, localDir)
+	if c.remapped() {
+		rel := strings.TrimPrefix(filepath.ToSlash(addedPath), "/")
+		addedPath = filepath.FromSlash(c.remoteRel(rel))
+	}
+	return filepath.Join(c.remoteDir, addedPath), nil
+}
 
-	go func() {
-		dst, err := sess.StdinPipe()
+// remoteCreateDir is fired when the directory at `localPath` is created.  The
+// directory is created on the remote along with anything already inside it,
+// since its contents may have been created before it was being watched.
+func (c *Client) remoteCreateDir(localPath string) error {
+	return c.walkLocal(localPath, func(p string, f os.FileInfo, err error) error {
 		if err != nil {
-			return
+			return nil
+		}
+		if f.IsDir() && c.hidden(p) {
+			return filepath.SkipDir
+		}
+		if c.ignored(p) {
+			return nil
 		}
-		defer dst.Close()
 
-		// TODO: We should probably only copy `sz` number of bytes here.
-		fmt.Fprintf(dst, "C%s %d %s\n", perms, sz, file)
-		io.Copy(dst, src)
-		fmt.Fprintf(dst, "\x00")
-	}()
+		remotePath, err := c.remotePathFor(p)
+		if err != nil {
+			return err
+		}
+		if f.IsDir() {
+			return c.makeRemoteDir(remotePath)
+		}
+		return c.syncLocalFileToRemote(p, remotePath)
+	})
+}
 
-	return sess.Run("/usr/bin/scp -qt " + dirp)
+// remoteCreateFile is fired when the tracked file residing at `localPath` is
+// created.
+func (c *Client) remoteCreateFile(localPath string) error {
+	return c.remoteUpdateFile(localPath)
 }
 
-//Copies the contents of an os.File to a remote location, it will get the length of the file by looking it up from the filesystem
-func (c *Client) copyFromFile(file os.File, remotePath string, perms string) error {
-	stat, _ := file.Stat()
-	return c.copy(&file, remotePath, perms, stat.Size())
+////////////////////////////////////////////////////////////////////////////////
+
+// localPathFor returns the absolute form of `localPath`, which is relative to
+// the local directory unless it is already absolute.  It is an error for the
+// path to be outside of the local directory.
+func (c *Client) localPathFor(localPath string) (string, error) {
+	if !filepath.IsAbs(localPath) {
+		localPath = filepath.Join(c.localDir, localPath)
+	}
+	localPath = filepath.Clean(localPath)
+
+	rel, err := filepath.Rel(c.localDir, localPath)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%s is not inside %s", localPath, c.localDir)
+	}
+	return localPath, nil
 }
 
-// sync two files where both local and remote are absolute paths.
-func (c *Client) syncLocalFileToRemote(local, remote string) error {
-	f_local, err := os.Open(local)
+// Sync pushes the file or directory at `localPath` to its place on the remote,
+// creating or updating it as needed.  This allows the client to be driven by
+// events from somewhere other than `StartShell` or `Watch`.  Relative paths
+// are taken to be relative to the local directory, and ignored paths are
+// skipped.
+func (c *Client) Sync(localPath string) error {
+	localPath, err := c.localPathFor(localPath)
 	if err != nil {
 		return err
 	}
-	defer f_local.Close()
+	if c.ignored(localPath) {
+		return nil
+	}
 
-	status := fmt.Sprintf("Sync file: %s --> %s", local, remote)
-	c.status(status)
-	if err := c.ensureRemoteDirectory(remote); err != nil {
+	fi, err := os.Stat(localPath)
+	if err != nil {
 		return err
 	}
-
-	return c.copyFromFile(*f_local, remote, "0755")
+	if fi.IsDir() {
+		return c.remoteCreateDir(localPath)
+	}
+	return c.remoteUpdateFile(localPath)
 }
 
-// remoteUpdateFile is fired when the tracked file residing at `localPath` is
-// updated.
-func (c *Client) remoteUpdateFile(localPath string) error {
-	localDir, err := filepath.Abs(c.localDir)
+// Remove removes the remote copy of `localPath`, see `Sync`.
+func (c *Client) Remove(localPath string) error {
+	localPath, err := c.localPathFor(localPath)
 	if err != nil {
 		return err
 	}
-
-	addedPath := strings.TrimPrefix(localPath, localDir)
-	remotePath := filepath.Join(c.remoteDir, addedPath)
-	return c.syncLocalFileToRemote(localPath, remotePath)
-}
-
-// remoteCreateFile is fired when the tracked file residing at `localPath` is
-// created.
-func (c *Client) remoteCreateFile(localPath string) error {
-	return c.remoteUpdateFile(localPath)
+	if c.ignored(localPath) {
+		return nil
+	}
+	return c.remoteRemoveFile(localPath)
 }
 
 ////////////////////////////////////////////////////////////////////////////////
@@ -381,7 +2508,33 @@ func (c *Client) SubscribeDir(dirpath string) error {
 	return notify.Watch(dirpath, c.events, notify.All)
 }
 
-// Close closes the `events` channel.
+// Close stops watching for changes and waits for `StartShell` to return before
+// closing the `events` channel.  If a manifest was requested, it is rewritten
+// to include any files synced since the initial sync.
 func (c *Client) Close() {
+	c.loopLock.Lock()
+	c.cancel()
+	c.loopLock.Unlock()
+
+	// Once `Stop` returns the watcher no longer sends on `events`.
+	notify.Stop(c.events)
+	c.loop.Wait()
 	close(c.events)
+
+	if len(c.opts.Manifest) > 0 {
+		c.writeManifest()
+	}
+	if sc := c.sftpSession(); sc != nil {
+		sc.Close()
+		<-c.sessions
+	}
+	if c.agent != nil {
+		c.agent.Close()
+	}
+	if c.target == nil && c.config != nil {
+		releaseShared(c.addr, c.config)
+	}
+	c.sums.save()
+	c.reportStats()
+	stdoutStatus.finish()
 }
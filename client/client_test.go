@@ -0,0 +1,298 @@
+package client
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// awkwardNames are file names which break commands if they are not quoted.
+var awkwardNames = []string{
+	"plain",
+	"with space",
+	"$HOME",
+	"a;touch pwned",
+	"it's",
+	"`id`",
+	"$(id)",
+	"new\nline",
+	"*",
+	"-rf",
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// newLocalClient returns a client for `localDir` whose remote commands run on
+// this machine, through a container target which runs them with `env`.
+func newLocalClient(t *testing.T, localDir, remoteDir string, opts Options) *Client {
+	t.Helper()
+	opts, err := withDefaults(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := &containerTarget{exec: []string{"env"}, tty: []string{"env"}}
+	c, err := newClient(nil, nil, target, localDir, remoteDir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestRemotePathForSymlinkedLocalDir(t *testing.T) {
+	real := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(real, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(real, "sub", "f.txt"), []byte("f"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(t.TempDir(), "link")
+	if err := os.Symlink(real, link); err != nil {
+		t.Skip("symlinks unsupported: ", err)
+	}
+
+	c := newLocalClient(t, link, "/srv/app", Options{DryRun: true})
+
+	// Walks and the watcher report paths through the resolved directory.
+	resolved, err := filepath.EvalSymlinks(real)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		local, remote string
+	}{
+		{filepath.Join(resolved, "sub", "f.txt"), "/srv/app/sub/f.txt"},
+		{filepath.Join(resolved, "sub"), "/srv/app/sub"},
+		{resolved, "/srv/app"},
+	} {
+		got, err := c.remotePathFor(tc.local)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tc.remote {
+			t.Errorf("remotePathFor(%q) = %q, want %q", tc.local, got, tc.remote)
+		}
+	}
+
+	files := []string{}
+	if err := c.walkLocal(c.localDir, func(p string, fi os.FileInfo, err error) error {
+		if err == nil && fi.Mode().IsRegular() {
+			files = append(files, c.relPath(p))
+		}
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0] != filepath.Join("sub", "f.txt") {
+		t.Errorf("walked %q, want [sub/f.txt]", files)
+	}
+}
+
+func TestRunCapture(t *testing.T) {
+	c := newLocalClient(t, t.TempDir(), t.TempDir(), Options{})
+	for _, tc := range []struct {
+		cmd            string
+		stdout, stderr string
+		code           int
+	}{
+		{"printf ok", "ok", "", 0},
+		{"echo out; echo err >&2; exit 3", "out\n", "err\n", 3},
+		{"exit 127", "", "", 127},
+	} {
+		stdout, stderr, code, err := c.RunCapture(context.Background(), tc.cmd)
+		if err != nil {
+			t.Errorf("RunCapture(%q) failed: %s", tc.cmd, err)
+			continue
+		}
+		if stdout != tc.stdout || stderr != tc.stderr || code != tc.code {
+			t.Errorf("RunCapture(%q) = %q, %q, %d, want %q, %q, %d",
+				tc.cmd, stdout, stderr, code, tc.stdout, tc.stderr, tc.code)
+		}
+	}
+	if n := len(c.sessions); n != 0 {
+		t.Errorf("%d sessions still held", n)
+	}
+}
+
+func TestRunCaptureCancel(t *testing.T) {
+	c := newLocalClient(t, t.TempDir(), t.TempDir(), Options{})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, _, code, err := c.RunCapture(ctx, "sleep 10")
+	if err != context.DeadlineExceeded || code != -1 {
+		t.Errorf("RunCapture = %d, %v, want -1, %v", code, err, context.DeadlineExceeded)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("RunCapture took %s to return after cancelling", d)
+	}
+}
+
+func TestRunCaptureStartError(t *testing.T) {
+	c := newLocalClient(t, t.TempDir(), t.TempDir(), Options{CommandRetries: 2})
+
+	// A session which cannot start is retried, then reported as an error.
+	c.target = &containerTarget{exec: []string{filepath.Join(t.TempDir(), "missing")}}
+	_, _, code, err := c.RunCapture(context.Background(), "true")
+	if err == nil || code != -1 {
+		t.Errorf("RunCapture = %d, %v, want -1 and an error", code, err)
+	}
+	if n := len(c.sessions); n != 0 {
+		t.Errorf("%d sessions still held", n)
+	}
+}
+
+func TestShellQuote(t *testing.T) {
+	for _, s := range append(awkwardNames, "") {
+		out, err := exec.Command("sh", "-c", "printf %s "+shellQuote(s)).Output()
+		if err != nil {
+			t.Errorf("sh failed for %q: %s", s, err)
+		} else if string(out) != s {
+			t.Errorf("shellQuote(%q) read back as %q", s, out)
+		}
+	}
+}
+
+func TestRemoteCommandsQuotePaths(t *testing.T) {
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := t.TempDir()
+	defer func() {
+		for _, dir := range []string{cwd, root} {
+			if _, err := os.Lstat(filepath.Join(dir, "pwned")); err == nil {
+				os.Remove(filepath.Join(dir, "pwned"))
+				t.Errorf("a path was run as a command in %s", dir)
+			}
+		}
+	}()
+
+	c := newLocalClient(t, t.TempDir(), root, Options{})
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	for _, name := range awkwardNames {
+		dir := filepath.Join(root, name, name)
+		if err := c.makeRemoteDir(dir); err != nil {
+			t.Errorf("mkdir %q: %s", name, err)
+			continue
+		}
+		from, to := filepath.Join(dir, name), filepath.Join(dir, name+".moved")
+		if err := ioutil.WriteFile(from, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := c.runRemoteCommand(c.shell.rename(from, to)); err != nil {
+			t.Errorf("rename %q: %s", name, err)
+		} else if bs, err := ioutil.ReadFile(to); err != nil || string(bs) != name {
+			t.Errorf("rename %q: read back %q, %v", name, bs, err)
+		}
+
+		if err := c.setRemoteModTime(to, mtime); err != nil {
+			t.Errorf("touch %q: %s", name, err)
+		} else if fi, err := os.Stat(to); err != nil || !fi.ModTime().Equal(mtime) {
+			t.Errorf("touch %q: modification time not set (%v)", name, err)
+		}
+
+		if err := c.runRemoteCommand(c.shell.remove(to)); err != nil {
+			t.Errorf("remove %q: %s", name, err)
+		} else if _, err := os.Lstat(to); !os.IsNotExist(err) {
+			t.Errorf("remove %q: still exists (%v)", name, err)
+		}
+	}
+}
+
+func TestSyncFileModTime(t *testing.T) {
+	local, remote := t.TempDir(), t.TempDir()
+	c := newLocalClient(t, local, remote, Options{})
+	lp, rp := filepath.Join(local, "f.txt"), filepath.Join(remote, "f.txt")
+
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := ioutil.WriteFile(lp, []byte("local"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(lp, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.syncFile(lp, rp); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(rp); err != nil || !fi.ModTime().Equal(mtime) {
+		t.Fatalf("synced file has time %v (%v), want %v", fi.ModTime(), err, mtime)
+	}
+
+	// A change to only the time is sent without the contents, which are
+	// changed on the remote here to tell the two apart.
+	if err := ioutil.WriteFile(rp, []byte("remote"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	mtime = mtime.Add(time.Hour)
+	if err := os.Chtimes(lp, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.syncFile(lp, rp); err != nil {
+		t.Fatal(err)
+	}
+	if bs, err := ioutil.ReadFile(rp); err != nil || string(bs) != "remote" {
+		t.Errorf("touched file was sent again: read back %q, %v", bs, err)
+	}
+	if fi, err := os.Stat(rp); err != nil || !fi.ModTime().Equal(mtime) {
+		t.Errorf("touched file has time %v (%v), want %v", fi.ModTime(), err, mtime)
+	}
+}
+
+func TestSyncFileNoTimes(t *testing.T) {
+	local, remote := t.TempDir(), t.TempDir()
+	c := newLocalClient(t, local, remote, Options{NoTimes: true})
+	lp, rp := filepath.Join(local, "f.txt"), filepath.Join(remote, "f.txt")
+
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := ioutil.WriteFile(lp, []byte("local"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(lp, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.syncFile(lp, rp); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(rp); err != nil || fi.ModTime().Equal(mtime) {
+		t.Errorf("synced file has time %v (%v), want the time it was written", fi.ModTime(), err)
+	}
+}
+
+func TestSyncFileModeOnly(t *testing.T) {
+	local, remote := t.TempDir(), t.TempDir()
+	c := newLocalClient(t, local, remote, Options{})
+	lp, rp := filepath.Join(local, "run.sh"), filepath.Join(remote, "run.sh")
+
+	if err := ioutil.WriteFile(lp, []byte("local"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.syncFile(lp, rp); err != nil {
+		t.Fatal(err)
+	}
+
+	// A change to only the mode is sent without the contents, which are
+	// changed on the remote here to tell the two apart.
+	if err := ioutil.WriteFile(rp, []byte("remote"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(lp, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.syncFile(lp, rp); err != nil {
+		t.Fatal(err)
+	}
+	if bs, err := ioutil.ReadFile(rp); err != nil || string(bs) != "remote" {
+		t.Errorf("chmodded file was sent again: read back %q, %v", bs, err)
+	}
+	if fi, err := os.Stat(rp); err != nil || fi.Mode().Perm() != 0755 {
+		t.Errorf("chmodded file has mode %v (%v), want 0755", fi.Mode().Perm(), err)
+	}
+}
@@ -0,0 +1,100 @@
+package client
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+
+const (
+	// DefaultCompressMinSize is the smallest file which is compressed, for
+	// anything smaller the savings do not cover the cost of another session.
+	DefaultCompressMinSize = 64 * 1024
+
+	// compressSampleSize is how much of a file is test compressed to decide
+	// whether compressing the rest is worthwhile.
+	compressSampleSize = 64 * 1024
+
+	// compressMaxRatio is the largest compressed to original size ratio of
+	// the sample for which the file is compressed.  Already compressed data
+	// (images, archives) does not shrink, and is sent as is.
+	compressMaxRatio = 0.9
+)
+
+// compressible returns true if a sample from the start of `f` shrinks enough
+// when compressed.  The file offset is restored before returning.
+func compressible(f *os.File) (bool, error) {
+	sample := make([]byte, compressSampleSize)
+	n, err := io.ReadFull(f, sample)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return false, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return false, err
+	}
+
+	var buf bytes.Buffer
+	zw, _ := gzip.NewWriterLevel(&buf, gzip.BestSpeed)
+	zw.Write(sample[:n])
+	zw.Close()
+	return n > 0 && float64(buf.Len()) < float64(n)*compressMaxRatio, nil
+}
+
+// compressLocalFileToRemote sends `f` gzip compressed to the remote, where it
+// is decompressed into `remote` and given the permissions `perms`.  The file
+// is replaced atomically, see `writeAtomic`.
+func (c *Client) compressLocalFileToRemote(f *os.File, remote, perms string, sz int64) error {
+	return c.writeAtomic(remote, sz, func(dst string) error {
+		return c.compressTo(c.ctx, f, dst, perms, sz)
+	})
+}
+
+// compressTo does the work of `compressLocalFileToRemote`, decompressing into
+// `remote` as it goes.  Cancelling `ctx` closes the session part way.
+func (c *Client) compressTo(ctx context.Context, f *os.File, remote, perms string, sz int64) error {
+	sess, err := c.newSession()
+	if err != nil {
+		return err
+	}
+	defer c.closeSession(sess)
+	defer closeOnCancel(ctx, sess)()
+
+	dst, err := sess.StdinPipe()
+	if err != nil {
+		return err
+	}
+
+	cmd := fmt.Sprintf("gzip -dc > %s && chmod %s %s", shellQuote(remote), perms, shellQuote(remote))
+	if err := sess.Start(cmd); err != nil {
+		return err
+	}
+
+	src, done := c.withProgress(f, remote, sz)
+	err = func() error {
+		defer done()
+		defer dst.Close()
+
+		zw, err := gzip.NewWriterLevel(c.throttleWriter(dst), gzip.DefaultCompression)
+		if err != nil {
+			return err
+		}
+		if n, err := io.CopyN(zw, src, sz); err == io.EOF {
+			return fmt.Errorf("short read, sent %d of %d bytes for %s", n, sz, remote)
+		} else if err != nil {
+			return err
+		}
+		return zw.Close()
+	}()
+	if err == nil {
+		err = sess.Wait()
+	}
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
@@ -0,0 +1,206 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+
+// containerTarget describes a docker container or kubernetes pod which is
+// synced to by running commands in it with the local `docker` or `kubectl`.
+type containerTarget struct {
+	exec []string // command prefix which runs its arguments in the container
+	tty  []string // command prefix which runs its arguments with a terminal
+}
+
+// parseContainerAddr parses addresses of the form `docker://container:/path`
+// and `k8s://pod:/path`.  The last return value is false if `addr` does not
+// refer to a container.
+func parseContainerAddr(addr string) (*containerTarget, string, bool) {
+	var scheme, rest string
+	switch {
+	case strings.HasPrefix(addr, "docker://"):
+		scheme, rest = "docker", strings.TrimPrefix(addr, "docker://")
+	case strings.HasPrefix(addr, "k8s://"):
+		scheme, rest = "k8s", strings.TrimPrefix(addr, "k8s://")
+	default:
+		return nil, "", false
+	}
+
+	name, dir := rest, ""
+	if i := strings.Index(rest, ":"); i >= 0 {
+		name, dir = rest[:i], rest[i+1:]
+	}
+
+	if scheme == "docker" {
+		return &containerTarget{
+			exec: []string{"docker", "exec", "-i", name},
+			tty:  []string{"docker", "exec", "-it", name},
+		}, dir, true
+	}
+	return &containerTarget{
+		exec: []string{"kubectl", "exec", "-i", name, "--"},
+		tty:  []string{"kubectl", "exec", "-it", name, "--"},
+	}, dir, true
+}
+
+// newSession returns a session which runs its command inside the container.
+func (t *containerTarget) newSession() session {
+	return &execSession{
+		cmd:    exec.Command(t.exec[0]),
+		prefix: t.exec,
+	}
+}
+
+// startShell runs an interactive shell, or `shellCmd` if it is set, in the
+// container attached to the local terminal.  The container tooling takes care
+// of the terminal modes.
+func (t *containerTarget) startShell(shellCmd string) (func(), error) {
+	args := append(append([]string{}, t.tty[1:]...), "sh")
+	if len(shellCmd) > 0 {
+		args = append(args, "-c", shellCmd)
+	}
+
+	cmd := exec.Command(t.tty[0], args...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	}, nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// containerTransfer streams files into the container with `cat`, as most
+// images have no scp.
+type containerTransfer struct {
+	c *Client
+}
+
+func (t containerTransfer) Upload(src io.Reader, dst string, mode os.FileMode, sz int64) error {
+	return t.c.catTo(t.c.ctx, src, dst, fmt.Sprintf("%04o", mode.Perm()), sz)
+}
+
+// catTo writes `sz` bytes from `src` to `remote` with `perms` by piping them
+// to `cat`.  Cancelling `ctx` closes the session part way.
+func (c *Client) catTo(ctx context.Context, src io.Reader, remote, perms string, sz int64) error {
+	sess, err := c.newSession()
+	if err != nil {
+		return err
+	}
+	defer c.closeSession(sess)
+	defer closeOnCancel(ctx, sess)()
+
+	dst, err := sess.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stderr, err := sess.StderrPipe()
+	if err != nil {
+		return err
+	}
+	var remoteErr bytes.Buffer
+	stderrDone := make(chan struct{})
+	go func() {
+		io.Copy(&remoteErr, stderr)
+		close(stderrDone)
+	}()
+
+	cmd := fmt.Sprintf("cat > %s && chmod %s %s", shellQuote(remote), perms, shellQuote(remote))
+	if err := sess.Start(cmd); err != nil {
+		return err
+	}
+
+	err = func() error {
+		defer dst.Close()
+		if n, err := io.CopyN(dst, src, sz); err == io.EOF {
+			return fmt.Errorf("short read, sent %d of %d bytes for %s", n, sz, remote)
+		} else if err != nil {
+			return err
+		}
+		return nil
+	}()
+
+	werr := sess.Wait()
+	<-stderrDone
+	if err == nil {
+		err = werr
+	}
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	} else if err != nil {
+		return withRemoteStderr(err, remoteErr.String())
+	}
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// execSession implements `session` by running a local command which in turn
+// runs the requested command in the container.
+type execSession struct {
+	cmd    *exec.Cmd
+	prefix []string
+
+	// The command is waited for once, by whichever of `Wait` and `Close`
+	// gets there first, and both see the same result.
+	waitOnce sync.Once
+	waitErr  error
+}
+
+func (s *execSession) StdinPipe() (io.WriteCloser, error) {
+	return s.cmd.StdinPipe()
+}
+
+func (s *execSession) StdoutPipe() (io.Reader, error) {
+	return s.cmd.StdoutPipe()
+}
+
+func (s *execSession) StderrPipe() (io.Reader, error) {
+	return s.cmd.StderrPipe()
+}
+
+func (s *execSession) Start(cmd string) error {
+	s.cmd.Args = append(append([]string{}, s.prefix...), "sh", "-c", cmd)
+	return s.cmd.Start()
+}
+
+func (s *execSession) Wait() error {
+	s.waitOnce.Do(func() {
+		s.waitErr = s.cmd.Wait()
+	})
+	return s.waitErr
+}
+
+func (s *execSession) Run(cmd string) error {
+	if err := s.Start(cmd); err != nil {
+		return err
+	}
+	return s.Wait()
+}
+
+func (s *execSession) Output(cmd string) ([]byte, error) {
+	var stdout bytes.Buffer
+	s.cmd.Stdout = &stdout
+	err := s.Run(cmd)
+	return stdout.Bytes(), err
+}
+
+// Close kills the command if it is still running.
+func (s *execSession) Close() error {
+	if s.cmd.Process != nil {
+		s.cmd.Process.Kill()
+		s.Wait()
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+package client
+
+import (
+	"sort"
+	"time"
+
+	"github.com/rjeczalik/notify"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+
+// DefaultDebounce is the default window in which events for the same path are
+// coalesced into one.
+const DefaultDebounce = 200 * time.Millisecond
+
+// pendingEvent is an event which is waiting out the debounce window.
+type pendingEvent struct {
+	path     string
+	event    notify.Event
+	deadline time.Time
+}
+
+// pendingEvent is a `notify.EventInfo`, so that events which were held back
+// can be handed to an `EventHandler`.
+func (pe pendingEvent) Event() notify.Event { return pe.event }
+func (pe pendingEvent) Path() string        { return pe.path }
+func (pe pendingEvent) Sys() interface{}    { return nil }
+
+// debouncer coalesces bursts of events for the same path.  Each event pushes
+// back the deadline for its path, so only the last event in a burst is acted
+// on once the path has been quiet for `window`.
+type debouncer struct {
+	window  time.Duration
+	pending map[string]*pendingEvent
+	timer   *time.Timer
+}
+
+func newDebouncer(window time.Duration) *debouncer {
+	return &debouncer{
+		window:  window,
+		pending: map[string]*pendingEvent{},
+	}
+}
+
+// mergeEvents returns the event to act on when `next` follows `prev` for the
+// same path.  A write after a create still needs the create handling, since
+// the path may be a new directory.
+func mergeEvents(prev, next notify.Event) notify.Event {
+	if prev == notify.Create && next == notify.Write {
+		return prev
+	}
+	return next
+}
+
+// add records `event` for `path`, replacing any pending event for it.
+func (d *debouncer) add(path string, event notify.Event) {
+	if pe, ok := d.pending[path]; ok {
+		event = mergeEvents(pe.event, event)
+	}
+	d.pending[path] = &pendingEvent{
+		path:     path,
+		event:    event,
+		deadline: time.Now().Add(d.window),
+	}
+	d.reschedule()
+}
+
+// due removes and returns the pending events whose deadline has passed, in
+// the order they became due.
+func (d *debouncer) due() []*pendingEvent {
+	now := time.Now()
+	ret := []*pendingEvent{}
+	for path, pe := range d.pending {
+		if !pe.deadline.After(now) {
+			ret = append(ret, pe)
+			delete(d.pending, path)
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].deadline.Before(ret[j].deadline)
+	})
+	d.reschedule()
+	return ret
+}
+
+// C returns a channel which fires when the next pending event is due, or nil
+// if nothing is pending.
+func (d *debouncer) C() <-chan time.Time {
+	if d.timer == nil {
+		return nil
+	}
+	return d.timer.C
+}
+
+// reschedule points the timer at the earliest pending deadline.
+func (d *debouncer) reschedule() {
+	d.stop()
+
+	var next time.Time
+	for _, pe := range d.pending {
+		if next.IsZero() || pe.deadline.Before(next) {
+			next = pe.deadline
+		}
+	}
+	if !next.IsZero() {
+		d.timer = time.NewTimer(time.Until(next))
+	}
+}
+
+// stop releases the timer, pending events are dropped.
+func (d *debouncer) stop() {
+	if d.timer != nil {
+		d.timer.Stop()
+		d.timer = nil
+	}
+}
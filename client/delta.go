@@ -0,0 +1,352 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+
+// deltaBlockSize is the size of the blocks which are compared between the
+// local and remote copies of a file in `Delta` mode.
+const deltaBlockSize = 256 * 1024
+
+// deltaLiteralAlign is the alignment of each run of literal data sent with a
+// delta, so that the remote can cut most of a run out with whole block reads.
+const deltaLiteralAlign = 4096
+
+// DefaultDeltaMinSize is the smallest file which is transferred as a delta.
+// Smaller files are cheaper to just send in full.
+const DefaultDeltaMinSize = 1024 * 1024
+
+////////////////////////////////////////////////////////////////////////////////
+
+// cksumPoly is the CRC-32 polynomial used by POSIX `cksum`.
+const cksumPoly = 0x04c11db7
+
+var cksumTable = func() (t [256]uint32) {
+	for i := range t {
+		crc := uint32(i) << 24
+		for j := 0; j < 8; j++ {
+			if crc&(1<<31) != 0 {
+				crc = crc<<1 ^ cksumPoly
+			} else {
+				crc <<= 1
+			}
+		}
+		t[i] = crc
+	}
+	return t
+}()
+
+// cksumUpdate feeds the byte `b` to `crc`, most significant bit first as
+// `cksum` does.
+func cksumUpdate(crc uint32, b byte) uint32 {
+	return crc<<8 ^ cksumTable[byte(crc>>24)^b]
+}
+
+// cksumFinish returns what `cksum` prints for `n` bytes of data whose CRC so
+// far is `crc`: the length is fed in least significant byte first, and the
+// result is complemented.
+func cksumFinish(crc uint32, n int64) uint32 {
+	for ; n > 0; n >>= 8 {
+		crc = cksumUpdate(crc, byte(n))
+	}
+	return ^crc
+}
+
+// rollingCksum is the `cksum` of a window of `size` bytes which slides along
+// a file a byte at a time.  The CRC starts from zero so it is linear, which
+// means the byte leaving the window can be cancelled by xoring in its
+// contribution from `out`.
+type rollingCksum struct {
+	size int64
+	crc  uint32
+	out  [256]uint32 // the CRC of each byte followed by `size` zero bytes
+}
+
+func newRollingCksum(size int64) *rollingCksum {
+	var bits [8]uint32
+	for k := range bits {
+		crc := cksumUpdate(0, 1<<uint(k))
+		for i := int64(0); i < size; i++ {
+			crc = cksumUpdate(crc, 0)
+		}
+		bits[k] = crc
+	}
+
+	r := &rollingCksum{size: size}
+	for b := range r.out {
+		for k := range bits {
+			if b&(1<<uint(k)) != 0 {
+				r.out[b] ^= bits[k]
+			}
+		}
+	}
+	return r
+}
+
+// roll slides the window forward by one byte, `in` entering it and `out`
+// leaving it.
+func (r *rollingCksum) roll(in, out byte) {
+	r.crc = cksumUpdate(r.crc, in) ^ r.out[out]
+}
+
+// sum returns the `cksum` of the current window.
+func (r *rollingCksum) sum() uint32 {
+	return cksumFinish(r.crc, r.size)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// deltaBlock is a whole block of the remote file.  The weak sum is checked at
+// every offset of the local file, and the strong one confirms a match.
+type deltaBlock struct {
+	weak   uint32 // `cksum`
+	strong string // md5
+}
+
+// deltaOp is a step in rebuilding a file on the remote: either `n` blocks of
+// the old remote file starting at `block`, or `n` bytes of literal data from
+// offset `off` of the local file.
+type deltaOp struct {
+	block int // -1 for literal data
+	off   int64
+	n     int64
+}
+
+// remoteBlockSums returns the sums of each whole `deltaBlockSize` block of
+// the `remote` file.  A trailing partial block is never matched, so it is
+// left out.
+func (c *Client) remoteBlockSums(remote string) ([]deltaBlock, error) {
+	cmd := fmt.Sprintf(`f=%s; s=$(wc -c < "$f") || exit 1; n=$((s / %d)); i=0; `+
+		`while [ $i -lt $n ]; do `+
+		`w=$(dd if="$f" bs=%d skip=$i count=1 2>/dev/null | cksum) && `+
+		`m=$(dd if="$f" bs=%d skip=$i count=1 2>/dev/null | md5sum) || exit 1; `+
+		`echo $w $m; i=$((i+1)); done`,
+		shellQuote(remote), deltaBlockSize, deltaBlockSize, deltaBlockSize)
+	out, err := c.runRemoteCommandOutput(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	blocks := []deltaBlock{}
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		// Each line is of the form "<crc> <size> <md5> -".
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("delta: malformed block sum for %s", remote)
+		}
+		weak, err := strconv.ParseUint(fields[0], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("delta: malformed block sum for %s", remote)
+		}
+		blocks = append(blocks, deltaBlock{weak: uint32(weak), strong: fields[2]})
+	}
+	return blocks, scanner.Err()
+}
+
+// deltaOps matches the remote `blocks` against every offset of the local file
+// `r`, and returns the steps which rebuild the local file from them.
+func deltaOps(r io.Reader, blocks []deltaBlock) ([]deltaOp, error) {
+	index := map[uint32][]int{}
+	for i, b := range blocks {
+		index[b.weak] = append(index[b.weak], i)
+	}
+
+	ops := []deltaOp{}
+	var start, lit int64 // offsets of the window and of pending literal data
+	literal := func(end int64) {
+		if end > lit {
+			ops = append(ops, deltaOp{block: -1, off: lit, n: end - lit})
+		}
+	}
+
+	br := bufio.NewReaderSize(r, 64*1024)
+	roll := newRollingCksum(deltaBlockSize)
+	win := make([]byte, deltaBlockSize) // ring buffer starting at `head`
+	head, filled := 0, 0
+	for {
+		for filled < deltaBlockSize {
+			b, err := br.ReadByte()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				return nil, err
+			}
+			win[(head+filled)%deltaBlockSize] = b
+			roll.crc = cksumUpdate(roll.crc, b)
+			filled++
+		}
+		if filled < deltaBlockSize {
+			break
+		}
+
+		if match := matchBlock(index[roll.sum()], blocks, win, head); match >= 0 {
+			literal(start)
+			if n := len(ops); n > 0 && ops[n-1].block >= 0 && ops[n-1].block+int(ops[n-1].n) == match {
+				ops[n-1].n++
+			} else {
+				ops = append(ops, deltaOp{block: match, n: 1})
+			}
+			start += deltaBlockSize
+			lit = start
+			head, filled, roll.crc = 0, 0, 0
+			continue
+		}
+
+		b, err := br.ReadByte()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		roll.roll(b, win[head])
+		win[head] = b
+		head = (head + 1) % deltaBlockSize
+		start++
+	}
+	literal(start + int64(filled))
+	return ops, nil
+}
+
+// matchBlock returns which of the `candidates` blocks has the same md5 as the
+// window `win` starting at `head`, or -1 if none do.
+func matchBlock(candidates []int, blocks []deltaBlock, win []byte, head int) int {
+	if len(candidates) == 0 {
+		return -1
+	}
+	h := md5.New()
+	h.Write(win[head:])
+	h.Write(win[:head])
+	sum := hex.EncodeToString(h.Sum(nil))
+	for _, i := range candidates {
+		if blocks[i].strong == sum {
+			return i
+		}
+	}
+	return -1
+}
+
+// deltaLiteralSize returns the space taken by `n` bytes of literal data once
+// padded to `deltaLiteralAlign`.
+func deltaLiteralSize(n int64) int64 {
+	return (n + deltaLiteralAlign - 1) / deltaLiteralAlign * deltaLiteralAlign
+}
+
+// deltaLiterals returns the literal data of `ops` read from `f`, each run
+// padded with zeros to `deltaLiteralAlign`, along with its total size.
+func deltaLiterals(f io.ReaderAt, ops []deltaOp) (io.Reader, int64) {
+	rs, sz := []io.Reader{}, int64(0)
+	for _, op := range ops {
+		if op.block >= 0 {
+			continue
+		}
+		pad := deltaLiteralSize(op.n) - op.n
+		rs = append(rs, io.NewSectionReader(f, op.off, op.n), bytes.NewReader(make([]byte, pad)))
+		sz += op.n + pad
+	}
+	return io.MultiReader(rs...), sz
+}
+
+// deltaScript returns a shell script which rebuilds the file into `tmp` from
+// blocks of `old` and the literal data in `lit`, checks that it is `sz` bytes
+// long, and moves it over `old` with the permissions `perms`.
+func deltaScript(ops []deltaOp, old, lit, tmp, perms string, sz int64) string {
+	var b bytes.Buffer
+	b.WriteString("set -e\n{\n:\n")
+	var litOff int64
+	for _, op := range ops {
+		if op.block >= 0 {
+			fmt.Fprintf(&b, "dd if=%s bs=%d skip=%d count=%d 2>/dev/null\n",
+				shellQuote(old), deltaBlockSize, op.block, op.n)
+			continue
+		}
+		whole, rest := op.n/deltaLiteralAlign, op.n%deltaLiteralAlign
+		if whole > 0 {
+			fmt.Fprintf(&b, "dd if=%s bs=%d skip=%d count=%d 2>/dev/null\n",
+				shellQuote(lit), deltaLiteralAlign, litOff/deltaLiteralAlign, whole)
+		}
+		if rest > 0 {
+			fmt.Fprintf(&b, "dd if=%s bs=1 skip=%d count=%d 2>/dev/null\n",
+				shellQuote(lit), litOff+whole*deltaLiteralAlign, rest)
+		}
+		litOff += deltaLiteralSize(op.n)
+	}
+	fmt.Fprintf(&b, "} > %s\n", shellQuote(tmp))
+	fmt.Fprintf(&b, "test $(wc -c < %s) -eq %d\n", shellQuote(tmp), sz)
+	fmt.Fprintf(&b, "chmod %s %s\n", perms, shellQuote(tmp))
+	fmt.Fprintf(&b, "mv -f %s %s\n", shellQuote(tmp), shellQuote(old))
+	fmt.Fprintf(&b, "rm -f %s\n", shellQuote(lit))
+	return b.String()
+}
+
+// runRemoteScript runs `script` with `sh` on the remote, sending it on stdin
+// as it may be too long for a single command line.
+func (c *Client) runRemoteScript(script string) error {
+	sess, err := c.newSession()
+	if err != nil {
+		return err
+	}
+	defer c.closeSession(sess)
+	defer closeOnCancel(c.ctx, sess)()
+
+	stdin, err := sess.StdinPipe()
+	if err != nil {
+		return err
+	}
+	if err := sess.Start("sh -s"); err != nil {
+		return err
+	}
+	_, err = io.WriteString(stdin, script)
+	stdin.Close()
+	if err != nil {
+		return err
+	}
+	return sess.Wait()
+}
+
+// deltaLocalFileToRemote updates `remote` to match `f` by only sending the
+// data which is not already found in some block of the remote copy.  Blocks
+// are matched at any offset, so insertions and deletions only cost the bytes
+// which changed.  The new file is built alongside `remote` and renamed over
+// it with `perms`, so hardlinks to the old file are left untouched.  An error
+// is returned if the remote file cannot be patched, in which case the caller
+// should copy it in full.
+func (c *Client) deltaLocalFileToRemote(f *os.File, remote, perms string, sz int64) error {
+	blocks, err := c.remoteBlockSums(remote)
+	if err != nil {
+		return err
+	}
+	ops, err := deltaOps(io.NewSectionReader(f, 0, sz), blocks)
+	if err != nil {
+		return err
+	}
+
+	lit, tmp := remoteTempPath(remote), remoteTempPath(remote)
+	src, litSz := deltaLiterals(f, ops)
+	err = func() error {
+		src, done := c.withProgress(c.throttle(src), remote, litSz)
+		defer done()
+		return c.transferer().Upload(src, lit, 0600, litSz)
+	}()
+	if err == nil {
+		err = c.runRemoteScript(deltaScript(ops, remote, lit, tmp, perms, sz))
+	}
+	if err != nil {
+		c.removeRemoteTemp(tmp)
+		c.removeRemoteTemp(lit)
+		return err
+	}
+
+	c.status(fmt.Sprintf("Delta sent %d of %d bytes for %s", litSz, sz, remote))
+	return nil
+}
@@ -0,0 +1,178 @@
+package client
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+// localBlockSums returns the sums `remoteBlockSums` would for `data`.
+func localBlockSums(data []byte) []deltaBlock {
+	blocks := []deltaBlock{}
+	for off := 0; off+deltaBlockSize <= len(data); off += deltaBlockSize {
+		block := data[off : off+deltaBlockSize]
+		crc := uint32(0)
+		for _, b := range block {
+			crc = cksumUpdate(crc, b)
+		}
+		sum := md5.Sum(block)
+		blocks = append(blocks, deltaBlock{
+			weak:   cksumFinish(crc, deltaBlockSize),
+			strong: hex.EncodeToString(sum[:]),
+		})
+	}
+	return blocks
+}
+
+func TestCksum(t *testing.T) {
+	// The POSIX `cksum` of "123456789", with its length appended.
+	crc := uint32(0)
+	for _, b := range []byte("123456789") {
+		crc = cksumUpdate(crc, b)
+	}
+	if got := cksumFinish(crc, 9); got != 930766865 {
+		t.Errorf("cksum of 123456789 = %d, want 930766865", got)
+	}
+}
+
+func TestDeltaOps(t *testing.T) {
+	const bs = deltaBlockSize
+	rnd := rand.New(rand.NewSource(1))
+	old := make([]byte, 3*bs)
+	rnd.Read(old)
+	changed := func(off int) []byte {
+		data := append([]byte{}, old...)
+		data[off] ^= 0xff
+		return data
+	}
+	concat := func(parts ...[]byte) []byte {
+		return bytes.Join(parts, nil)
+	}
+
+	for _, tc := range []struct {
+		name string
+		old  []byte
+		new  []byte
+		ops  []deltaOp
+	}{
+		{"unchanged", old, old, []deltaOp{{block: 0, n: 3}}},
+		{"changed first", old, changed(10), []deltaOp{
+			{block: -1, off: 0, n: bs}, {block: 1, n: 2}}},
+		{"changed last", old, changed(2*bs + 10), []deltaOp{
+			{block: 0, n: 2}, {block: -1, off: 2 * bs, n: bs}}},
+		{"changed last of two", old[:2*bs], changed(bs + 10)[:2*bs], []deltaOp{
+			{block: 0, n: 1}, {block: -1, off: bs, n: bs}}},
+		{"insert", old, concat(old[:bs], []byte("abc"), old[bs:]), []deltaOp{
+			{block: 0, n: 1}, {block: -1, off: bs, n: 3}, {block: 1, off: 0, n: 2}}},
+		{"truncate", old, old[:bs+100], []deltaOp{
+			{block: 0, n: 1}, {block: -1, off: bs, n: 100}}},
+		{"append", old, concat(old, []byte("tail")), []deltaOp{
+			{block: 0, n: 3}, {block: -1, off: 3 * bs, n: 4}}},
+		{"empty", old, nil, []deltaOp{}},
+	} {
+		ops, err := deltaOps(bytes.NewReader(tc.new), localBlockSums(tc.old))
+		if err != nil {
+			t.Fatalf("%s: %s", tc.name, err)
+		}
+		if len(ops) != len(tc.ops) {
+			t.Errorf("%s: ops = %+v, want %+v", tc.name, ops, tc.ops)
+			continue
+		}
+		for i := range ops {
+			if ops[i] != tc.ops[i] {
+				t.Errorf("%s: ops = %+v, want %+v", tc.name, ops, tc.ops)
+				break
+			}
+		}
+
+		// Every op lies inside the new file, and together they cover it.
+		var n int64
+		for _, op := range ops {
+			if op.block < 0 && (op.off != n || op.off+op.n > int64(len(tc.new))) {
+				t.Errorf("%s: literal %+v outside of the %d byte file", tc.name, op, len(tc.new))
+			}
+			if op.block < 0 {
+				n += op.n
+			} else {
+				n += op.n * bs
+			}
+		}
+		if n != int64(len(tc.new)) {
+			t.Errorf("%s: ops cover %d bytes, want %d", tc.name, n, len(tc.new))
+		}
+	}
+}
+
+func TestDeltaScript(t *testing.T) {
+	for _, tool := range []string{"sh", "dd", "wc"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skip(tool, " not found")
+		}
+	}
+
+	const bs = deltaBlockSize
+	rnd := rand.New(rand.NewSource(2))
+	old := make([]byte, 3*bs)
+	rnd.Read(old)
+	changedLast := append([]byte{}, old...)
+	changedLast[2*bs+5] ^= 0xff
+
+	for name, data := range map[string][]byte{
+		"unchanged":    old,
+		"changed last": changedLast,
+		"insert":       bytes.Join([][]byte{old[:bs], make([]byte, 5000), old[bs:]}, nil),
+		"truncate":     old[:bs+100],
+		"append":       append(append([]byte{}, old...), "tail"...),
+	} {
+		dir := t.TempDir()
+		oldPath, litPath, tmpPath := filepath.Join(dir, "f"), filepath.Join(dir, "f.lit"), filepath.Join(dir, "f.tmp")
+		if err := ioutil.WriteFile(oldPath, old, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		ops, err := deltaOps(bytes.NewReader(data), localBlockSums(old))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, sz := deltaLiterals(bytes.NewReader(data), ops)
+		lit, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatalf("%s: reading literals: %s", name, err)
+		}
+		if int64(len(lit)) != sz {
+			t.Fatalf("%s: read %d bytes of literals, want %d", name, len(lit), sz)
+		}
+		if err := ioutil.WriteFile(litPath, lit, 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		script := deltaScript(ops, oldPath, litPath, tmpPath, "0755", int64(len(data)))
+		cmd := exec.Command("sh", "-s")
+		cmd.Stdin = bytes.NewReader([]byte(script))
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("%s: script failed: %s: %s", name, err, out)
+		}
+
+		got, err := ioutil.ReadFile(oldPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("%s: rebuilt %d bytes which differ from the %d wanted", name, len(got), len(data))
+		}
+		if fi, err := os.Stat(oldPath); err == nil && fi.Mode().Perm() != 0755 {
+			t.Errorf("%s: rebuilt file has mode %v, want 0755", name, fi.Mode().Perm())
+		}
+		for _, p := range []string{litPath, tmpPath} {
+			if _, err := os.Stat(p); !os.IsNotExist(err) {
+				t.Errorf("%s: %s left behind", name, filepath.Base(p))
+			}
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package client
+
+import (
+	"path/filepath"
+	"sync"
+
+	"github.com/rjeczalik/notify"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+
+// dispatchJob is an event, or other work on the local `paths`, waiting for or
+// being handled by a `dispatcher`.
+type dispatchJob struct {
+	paths   []string
+	fn      func()
+	event   bool // an event rather than other work, see `dispatcher.idle`
+	running bool
+}
+
+// dispatcher handles events on up to `workers` goroutines at once while
+// keeping the order in which they arrived for related paths.  Two paths are
+// related if they are the same or one is inside the other, so a write to a
+// file is always done before a later remove of it or of its directory, and
+// never races it to recreate the remote file.  Events for unrelated paths are
+// handled in parallel.  Other work which touches the remote copies of local
+// paths, such as the initial sync of a file or moving the remote copy of a
+// renamed one, is ordered along with the events the same way.
+type dispatcher struct {
+	handle  func(path string, event notify.Event)
+	idle    func() // called each time the last pending event is handled
+	workers int
+
+	lock    sync.Mutex
+	jobs    []*dispatchJob // pending and running, in the order they arrived
+	running int
+	changed bool // an event was handled since `idle` was last called
+	wg      sync.WaitGroup
+}
+
+func newDispatcher(workers int, handle func(string, notify.Event), idle func()) *dispatcher {
+	if workers < 1 {
+		workers = 1
+	}
+	return &dispatcher{handle: handle, idle: idle, workers: workers}
+}
+
+// add queues `event` for `path` behind any earlier jobs for related paths.
+func (d *dispatcher) add(path string, event notify.Event) {
+	d.queue(&dispatchJob{paths: []string{path}, fn: func() { d.handle(path, event) }, event: true})
+}
+
+// do queues `fn`, which works on the local `paths`, behind any earlier jobs
+// for paths related to any of them.  Later jobs for related paths wait for it
+// in turn.
+func (d *dispatcher) do(paths []string, fn func()) {
+	d.queue(&dispatchJob{paths: paths, fn: fn})
+}
+
+// addChange is `do` for work which syncs changes to the `paths`, and so counts
+// as an event for `idle`.
+func (d *dispatcher) addChange(paths []string, fn func()) {
+	d.queue(&dispatchJob{paths: paths, fn: fn, event: true})
+}
+
+func (d *dispatcher) queue(j *dispatchJob) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.jobs = append(d.jobs, j)
+	d.schedule()
+}
+
+// wait blocks until every queued event has been handled.
+func (d *dispatcher) wait() {
+	d.wg.Wait()
+}
+
+// schedule starts the jobs which have no earlier job for a related path, up to
+// `workers` at once.  The lock must be held.
+func (d *dispatcher) schedule() {
+	seen := map[string]bool{}    // paths of the earlier jobs
+	parents := map[string]bool{} // directories containing those paths
+	for _, j := range d.jobs {
+		if d.running >= d.workers {
+			return
+		}
+
+		blocked := false
+		for _, jp := range j.paths {
+			blocked = blocked || parents[jp]
+			for p := jp; !blocked; {
+				blocked = seen[p]
+				parent := filepath.Dir(p)
+				if parent == p {
+					break
+				}
+				p = parent
+			}
+		}
+
+		if !blocked && !j.running {
+			j.running = true
+			d.running++
+			d.wg.Add(1)
+			go d.run(j)
+		}
+
+		for _, jp := range j.paths {
+			seen[jp] = true
+			for p := filepath.Dir(jp); !parents[p]; p = filepath.Dir(p) {
+				parents[p] = true
+				if filepath.Dir(p) == p {
+					break
+				}
+			}
+		}
+	}
+}
+
+// run handles `j`, then starts whatever it was holding up.
+func (d *dispatcher) run(j *dispatchJob) {
+	defer d.wg.Done()
+	j.fn()
+
+	d.lock.Lock()
+	for i, other := range d.jobs {
+		if other == j {
+			d.jobs = append(d.jobs[:i], d.jobs[i+1:]...)
+			break
+		}
+	}
+	d.running--
+	d.schedule()
+	d.changed = d.changed || j.event
+	idle := len(d.jobs) == 0 && d.changed
+	if idle {
+		d.changed = false
+	}
+	d.lock.Unlock()
+
+	if idle && d.idle != nil {
+		d.idle()
+	}
+}
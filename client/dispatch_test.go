@@ -0,0 +1,170 @@
+package client
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rjeczalik/notify"
+)
+
+// dispatchRecorder records the order in which jobs start and finish.  Jobs
+// for paths in `hold` block until the path is released.
+type dispatchRecorder struct {
+	lock   sync.Mutex
+	log    []string
+	active int
+	most   int
+	hold   map[string]chan struct{}
+}
+
+func newDispatchRecorder(held ...string) *dispatchRecorder {
+	r := &dispatchRecorder{hold: map[string]chan struct{}{}}
+	for _, p := range held {
+		r.hold[p] = make(chan struct{})
+	}
+	return r
+}
+
+func (r *dispatchRecorder) handle(path string, event notify.Event) {
+	r.lock.Lock()
+	r.log = append(r.log, "start "+path)
+	r.active++
+	if r.active > r.most {
+		r.most = r.active
+	}
+	hold := r.hold[path]
+	r.lock.Unlock()
+
+	if hold != nil {
+		<-hold
+	}
+
+	r.lock.Lock()
+	r.log = append(r.log, "end "+path)
+	r.active--
+	r.lock.Unlock()
+}
+
+// started waits for the job for `path` to start.
+func (r *dispatchRecorder) started(t *testing.T, path string) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		r.lock.Lock()
+		for _, l := range r.log {
+			if l == "start "+path {
+				r.lock.Unlock()
+				return
+			}
+		}
+		r.lock.Unlock()
+	}
+	t.Fatalf("%s never started: %q", path, r.log)
+}
+
+// index returns where `entry` is in the log, or -1.
+func (r *dispatchRecorder) index(entry string) int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for i, l := range r.log {
+		if l == entry {
+			return i
+		}
+	}
+	return -1
+}
+
+func TestDispatcherOrdersRelatedPaths(t *testing.T) {
+	r := newDispatchRecorder("/a/f")
+	d := newDispatcher(4, r.handle, nil)
+
+	d.add("/a/f", notify.Write)
+	r.started(t, "/a/f")
+	d.add("/a/f", notify.Remove) // the same path
+	d.add("/a", notify.Remove)   // a parent
+	d.add("/a/f/g", notify.Write)
+	d.add("/b", notify.Write) // unrelated, so not held up
+	r.started(t, "/b")
+
+	for _, p := range []string{"/a", "/a/f/g"} {
+		if i := r.index("start " + p); i >= 0 {
+			t.Errorf("%s started while /a/f was running: %q", p, r.log)
+		}
+	}
+	close(r.hold["/a/f"])
+	d.wait()
+
+	if r.index("start /a") < r.index("end /a/f") || r.index("start /a/f/g") < r.index("end /a") {
+		t.Errorf("related paths handled out of order: %q", r.log)
+	}
+}
+
+func TestDispatcherWorkers(t *testing.T) {
+	r := newDispatchRecorder("/a", "/b", "/c")
+	d := newDispatcher(2, r.handle, nil)
+
+	for _, p := range []string{"/a", "/b", "/c"} {
+		d.add(p, notify.Write)
+	}
+	r.started(t, "/a")
+	r.started(t, "/b")
+	time.Sleep(10 * time.Millisecond)
+	if r.index("start /c") >= 0 {
+		t.Errorf("more than 2 jobs started at once: %q", r.log)
+	}
+	for _, p := range []string{"/a", "/b", "/c"} {
+		close(r.hold[p])
+	}
+	d.wait()
+	if r.most != 2 {
+		t.Errorf("%d jobs ran at once, want 2", r.most)
+	}
+}
+
+func TestDispatcherDoWaitsForEveryPath(t *testing.T) {
+	r := newDispatchRecorder("/new")
+	d := newDispatcher(4, r.handle, nil)
+
+	d.add("/new", notify.Create)
+	r.started(t, "/new")
+	d.do([]string{"/old", "/new"}, func() { r.handle("move", 0) })
+	d.add("/old", notify.Create)
+	time.Sleep(10 * time.Millisecond)
+	if r.index("start move") >= 0 || r.index("start /old") >= 0 {
+		t.Errorf("started before an earlier job for one of its paths finished: %q", r.log)
+	}
+	close(r.hold["/new"])
+	d.wait()
+
+	if r.index("start move") < r.index("end /new") || r.index("start /old") < r.index("end move") {
+		t.Errorf("jobs handled out of order: %q", r.log)
+	}
+}
+
+func TestDispatcherIdle(t *testing.T) {
+	r := newDispatchRecorder()
+	var lock sync.Mutex
+	idles := 0
+	d := newDispatcher(2, r.handle, func() {
+		lock.Lock()
+		idles++
+		lock.Unlock()
+	})
+
+	// Other work is not a change, so it does not make the dispatcher idle.
+	d.do([]string{"/a"}, func() {})
+	d.wait()
+	if idles != 0 {
+		t.Errorf("idle called %d times after other work, want 0", idles)
+	}
+
+	d.add("/a", notify.Write)
+	d.wait()
+	d.addChange([]string{"/b", "/c"}, func() {})
+	d.wait()
+	lock.Lock()
+	defer lock.Unlock()
+	if idles != 2 {
+		t.Errorf("idle called %d times after two changes, want 2", idles)
+	}
+}
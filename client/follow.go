@@ -0,0 +1,56 @@
+package client
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+
+// followedDirs is the set of directories created after startup which have
+// been subscribed to, see `Options.FollowNewDirs`.
+type followedDirs struct {
+	lock sync.Mutex
+	dirs map[string]bool
+}
+
+// add returns true if `p` was added to the set, or false if it or one of its
+// parents is already in it and so already watched.
+func (f *followedDirs) add(p string) bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	for d := p; ; d = filepath.Dir(d) {
+		if f.dirs[d] {
+			return false
+		}
+		if parent := filepath.Dir(d); parent == d {
+			break
+		}
+	}
+	if f.dirs == nil {
+		f.dirs = map[string]bool{}
+	}
+	f.dirs[p] = true
+	return true
+}
+
+// followNewDir subscribes to the tree under `p` if it is a directory which was
+// created after startup, so that its changes are seen even where the recursive
+// watch of the local directory does not pick up new subdirectories.  Each tree
+// is subscribed to once, and the subscription covers everything under it.
+func (c *Client) followNewDir(p string) {
+	if !c.opts.FollowNewDirs || !c.recursive || c.hidden(p) {
+		return
+	}
+	fi, err := os.Lstat(p)
+	if err != nil || !fi.IsDir() || !c.followed.add(p) {
+		return
+	}
+
+	if err := c.SubscribeDir(filepath.Join(p, "...")); err != nil {
+		c.status(fmt.Sprintf("Unable to watch %s: %s", p, err.Error()))
+	}
+}
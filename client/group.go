@@ -0,0 +1,278 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+
+// Group syncs the same local directory to several hosts at once.  Each host
+// has its own `Client` which watches for and syncs changes independently, so
+// a host which is slow or unreachable does not hold up the others.  The shell
+// is opened on the first host.
+type Group struct {
+	clients []*Client
+	done    chan struct{} // closed once every client has stopped
+}
+
+// NewGroup connects to each of `addrs` concurrently and returns a `Group` of
+// the hosts which could be reached.  Hosts which cannot be reached are reported
+// and skipped, an error is only returned if none of them could be.  With
+// `RemoteDirs` there is a client for each directory on each host, and those on
+// the same host share its connection.
+func NewGroup(addrs []string, localDir string, opts Options) (*Group, error) {
+	// `RateLimit` is the combined rate of the whole group, not of each host.
+	opts.limiter = newRateLimiter(opts.RateLimit)
+
+	type target struct {
+		addr string
+		opts Options
+	}
+	targets := []target{}
+	for _, addr := range addrs {
+		if len(opts.RemoteDirs) == 0 {
+			targets = append(targets, target{addr: addr, opts: opts})
+			continue
+		}
+		for _, dir := range opts.RemoteDirs {
+			o := opts
+			o.RemoteDir = dir
+			targets = append(targets, target{addr: addr, opts: o})
+		}
+	}
+
+	// Each target writes its own local manifest, rather than all of them
+	// writing over the same file.
+	if len(targets) > 1 && len(opts.Manifest) > 0 {
+		for i, t := range targets {
+			targets[i].opts.Manifest = targetManifestPath(opts.Manifest, t.addr, t.opts.RemoteDir)
+		}
+	}
+
+	clients := make([]*Client, len(targets))
+	errs := make([]error, len(targets))
+
+	var wg sync.WaitGroup
+	for i, t := range targets {
+		wg.Add(1)
+		go func(i int, t target) {
+			defer wg.Done()
+			clients[i], errs[i] = New(t.addr, localDir, t.opts)
+		}(i, t)
+	}
+	wg.Wait()
+
+	if len(targets) == 1 {
+		if errs[0] != nil {
+			return nil, errs[0]
+		}
+		return newGroup(clients), nil
+	}
+
+	reachable := []*Client{}
+	for i, c := range clients {
+		if errs[i] != nil {
+			msg := fmt.Sprintf("Skipping %s: %s", withoutPassword(targets[i].addr), errs[i])
+			if opts.Redact {
+				msg = Redact(msg)
+			}
+			stdoutStatus.fprintln(os.Stderr, msg)
+			continue
+		}
+
+		c.label = c.addr
+		if len(c.label) == 0 {
+			c.label = targets[i].addr // containers
+		}
+		if len(opts.RemoteDirs) > 1 {
+			c.label += ":" + c.remoteDir
+		}
+		reachable = append(reachable, c)
+	}
+	if len(reachable) == 0 {
+		return nil, fmt.Errorf("unable to connect to any of the %d destinations", len(targets))
+	}
+	return newGroup(reachable), nil
+}
+
+// withoutPassword strips the password, if any, from a `user:pass@host` address.
+func withoutPassword(addr string) string {
+	at := strings.LastIndex(addr, "@")
+	if at < 0 {
+		return addr
+	}
+	if i := strings.Index(addr[:at], ":"); i >= 0 {
+		return addr[:i] + addr[at:]
+	}
+	return addr
+}
+
+// newGroup returns a `Group` of connected `clients`.
+func newGroup(clients []*Client) *Group {
+	g := &Group{
+		clients: clients,
+		done:    make(chan struct{}),
+	}
+	go func() {
+		for _, c := range g.clients {
+			<-c.Done()
+		}
+		close(g.done)
+	}()
+	return g
+}
+
+// each calls `fn` for every client concurrently, and waits for them to return.
+func (g *Group) each(fn func(c *Client)) {
+	var wg sync.WaitGroup
+	for _, c := range g.clients {
+		wg.Add(1)
+		go func(c *Client) {
+			defer wg.Done()
+			fn(c)
+		}(c)
+	}
+	wg.Wait()
+}
+
+// AddTransform registers the transform with every client, see
+// `Client.AddTransform`.
+func (g *Group) AddTransform(pattern string, fn TransformFunc) {
+	for _, c := range g.clients {
+		c.AddTransform(pattern, fn)
+	}
+}
+
+// StartShell syncs changes to every host, with a shell open on the first.  It
+// returns once the first host's client is closed.
+func (g *Group) StartShell(skipInitialSync bool) error {
+	for _, c := range g.clients[1:] {
+		go func(c *Client) {
+			if err := c.Watch(skipInitialSync); err != nil {
+				c.status(fmt.Sprintf("Stopped syncing: %s", err))
+			}
+		}(c)
+	}
+	return g.clients[0].StartShell(skipInitialSync)
+}
+
+// Watch syncs changes to every host without opening a shell, see
+// `Client.Watch`.  It returns once every client is closed.
+func (g *Group) Watch(skipInitialSync bool) error {
+	var lock sync.Mutex
+	errs := []error{}
+	g.each(func(c *Client) {
+		if err := c.Watch(skipInitialSync); err != nil {
+			lock.Lock()
+			errs = append(errs, g.hostError(c, err))
+			lock.Unlock()
+		}
+	})
+	return joinErrors(errs)
+}
+
+// Pull mirrors the remote directory into the local one, see `Client.Pull`.
+// Only a single host may be pulled from.
+func (g *Group) Pull() error {
+	if len(g.clients) != 1 {
+		return errors.New("pull requires a single host")
+	}
+	return g.clients[0].Pull()
+}
+
+// SyncOnce syncs the local directory to every host concurrently.  The error
+// lists each host which did not sync completely.
+func (g *Group) SyncOnce() error {
+	var lock sync.Mutex
+	errs := []error{}
+	g.each(func(c *Client) {
+		if err := c.SyncOnce(); err != nil {
+			lock.Lock()
+			errs = append(errs, g.hostError(c, err))
+			lock.Unlock()
+		}
+	})
+	return joinErrors(errs)
+}
+
+// hostError prefixes `err` with the host it came from when there are several.
+func (g *Group) hostError(c *Client, err error) error {
+	if len(c.label) == 0 {
+		return err
+	}
+	return fmt.Errorf("%s: %s", c.label, err)
+}
+
+// joinErrors returns a single error for `errs`, or nil if there are none.
+func joinErrors(errs []error) error {
+	switch len(errs) {
+	case 0:
+		return nil
+	case 1:
+		return errs[0]
+	}
+	msgs := make([]string, len(errs))
+	for i, err := range errs {
+		msgs[i] = err.Error()
+	}
+	return fmt.Errorf("%s", strings.Join(msgs, "; "))
+}
+
+// Failures returns the number of changes which have failed to sync across all
+// hosts.
+func (g *Group) Failures() int {
+	n := 0
+	for _, c := range g.clients {
+		n += c.Failures()
+	}
+	return n
+}
+
+// Report prints the number of changes which failed to sync to each host, if
+// any did.
+func (g *Group) Report() {
+	for _, c := range g.clients {
+		if n := c.Failures(); n > 0 {
+			stdoutStatus.fprintln(os.Stderr, c.labelled(fmt.Sprintf("Warning: %d changes failed to sync", n)))
+		} else if len(c.label) > 0 && !c.opts.Quiet {
+			stdoutStatus.println(c.labelled("All changes synced"))
+		}
+	}
+}
+
+// Done returns a channel which is closed once every host has stopped.
+func (g *Group) Done() <-chan struct{} {
+	return g.done
+}
+
+// Err returns the reasons any of the hosts' connections were lost.
+func (g *Group) Err() error {
+	errs := []error{}
+	for _, c := range g.clients {
+		if err := c.Err(); err != nil {
+			errs = append(errs, g.hostError(c, err))
+		}
+	}
+	return joinErrors(errs)
+}
+
+// IdleTimedOut returns true if every host stopped because of `IdleTimeout`.
+func (g *Group) IdleTimedOut() bool {
+	for _, c := range g.clients {
+		if !c.IdleTimedOut() {
+			return false
+		}
+	}
+	return true
+}
+
+// Close closes every client concurrently, see `Client.Close`.
+func (g *Group) Close() {
+	g.each(func(c *Client) {
+		c.Close()
+	})
+}
@@ -0,0 +1,109 @@
+package client
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+
+// knownHostsPath returns the path to the current user's known_hosts file.
+func knownHostsPath() (string, error) {
+	u, err := user.Current()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(u.HomeDir, ".ssh", "known_hosts"), nil
+}
+
+// ensureFile creates an empty file at `p` (and its parent directory) if one
+// does not already exist.
+func ensureFile(p string) error {
+	if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(p, os.O_CREATE|os.O_RDONLY, 0600)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// promptLock serializes prompts on the terminal, which may otherwise be
+// interleaved when connecting to several hosts at once.
+var promptLock sync.Mutex
+
+// stdinReader reads answers to prompts from stdin.  There is only the one, as
+// a reader per prompt may buffer input meant for the next prompt and lose it.
+// It is guarded by `promptLock`, and is handed to the shell once connected.
+var stdinReader = bufio.NewReader(os.Stdin)
+
+// confirm prints `prompt` and returns true if the user answers "yes".  The
+// caller must hold `promptLock`.
+func confirm(prompt string) bool {
+	fmt.Printf("%s (yes/no)? ", prompt)
+	answer, err := stdinReader.ReadString('\n')
+	if err != nil {
+		return false
+	}
+	return strings.TrimSpace(strings.ToLower(answer)) == "yes"
+}
+
+// knownHostsCallback returns a `ssh.HostKeyCallback` which verifies host keys
+// against the user's known_hosts file.  Keys for unknown hosts are shown to
+// the user who may accept them, in which case they are added to the file.  A
+// key which does not match the known one is always rejected.
+func knownHostsCallback() (ssh.HostKeyCallback, error) {
+	p, err := knownHostsPath()
+	if err != nil {
+		return nil, err
+	}
+	if err := ensureFile(p); err != nil {
+		return nil, err
+	}
+
+	check, err := knownhosts.New(p)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		err := check(hostname, remote, key)
+		keyErr, ok := err.(*knownhosts.KeyError)
+		if !ok {
+			return err
+		}
+		if len(keyErr.Want) > 0 {
+			return fmt.Errorf("host key for %s has changed, this could be a man-in-the-middle attack: %s", hostname, err)
+		}
+
+		promptLock.Lock()
+		defer promptLock.Unlock()
+
+		fmt.Printf("The authenticity of host '%s' can't be established.\n", hostname)
+		fmt.Printf("%s key fingerprint is %s.\n", key.Type(), ssh.FingerprintSHA256(key))
+		if !confirm("Are you sure you want to continue connecting") {
+			return errors.New("host key verification failed")
+		}
+
+		f, err := os.OpenFile(p, os.O_APPEND|os.O_WRONLY, 0600)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		line := knownhosts.Line([]string{knownhosts.Normalize(hostname)}, key)
+		_, err = fmt.Fprintln(f, line)
+		return err
+	}, nil
+}
@@ -0,0 +1,58 @@
+package client
+
+import (
+	"errors"
+	"time"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+
+// ErrIdleTimeout is the reason a client stops once `IdleTimeout` passes
+// without a change to the local directory, see `Err`.
+var ErrIdleTimeout = errors.New("idle timeout")
+
+// idleTimer fires once `timeout` passes without a call to `reset`, see
+// `Options.IdleTimeout`.  It does nothing until it is started, or at all if
+// the timeout is zero.
+type idleTimer struct {
+	timeout time.Duration
+	timer   *time.Timer
+}
+
+// start starts the timer, if it is enabled and not already running.
+func (i *idleTimer) start() {
+	if i.timeout > 0 && i.timer == nil {
+		i.timer = time.NewTimer(i.timeout)
+	}
+}
+
+// reset restarts the timer if it is running.
+func (i *idleTimer) reset() {
+	if i.timer != nil {
+		if !i.timer.Stop() {
+			<-i.timer.C
+		}
+		i.timer.Reset(i.timeout)
+	}
+}
+
+// C returns a channel which fires when the timeout passes, or nil if the timer
+// is not running.
+func (i *idleTimer) C() <-chan time.Time {
+	if i.timer == nil {
+		return nil
+	}
+	return i.timer.C
+}
+
+// stop releases the timer.
+func (i *idleTimer) stop() {
+	if i.timer != nil {
+		i.timer.Stop()
+	}
+}
+
+// IdleTimedOut returns true if the client stopped because of `IdleTimeout`.
+func (c *Client) IdleTimedOut() bool {
+	return c.Err() == ErrIdleTimeout
+}
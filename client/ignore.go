@@ -0,0 +1,129 @@
+package client
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+
+// vcsDirs are the version control metadata directories which are skipped with
+// `ExcludeVCS`: git, subversion, mercurial, bazaar, CVS and darcs.
+var vcsDirs = map[string]bool{
+	".git":   true,
+	".svn":   true,
+	".hg":    true,
+	".bzr":   true,
+	"CVS":    true,
+	"_darcs": true,
+}
+
+// editorTempPatterns match the swap, backup and temporary files which editors
+// create and remove as they go, which are skipped unless `SyncEditorTemp` is
+// set.  "4913" is the file vim creates to test that a directory is writable.
+var editorTempPatterns = []string{
+	"*.swp", "*.swo", "*.swx", // vim
+	"4913",
+	"*~",
+	".#*", "#*#", // emacs
+	"*.tmp",
+	"*.kate-swp",
+}
+
+// isEditorTemp returns true if the base name of `p` is one of the
+// `editorTempPatterns`.
+func isEditorTemp(p string) bool {
+	base := filepath.Base(p)
+	for _, pattern := range editorTempPatterns {
+		if ok, _ := filepath.Match(pattern, base); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// relPath returns `p` relative to the local directory, or `p` itself if it is
+// not under the local directory.
+func (c *Client) relPath(p string) string {
+	rel, err := filepath.Rel(c.localDir, p)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return p
+	}
+	return rel
+}
+
+// hasExtension returns true if `p` has one of the `Extensions`.  Extensions
+// are compared case-insensitively and without the leading dot.
+func (c *Client) hasExtension(p string) bool {
+	ext := strings.ToLower(strings.TrimPrefix(filepath.Ext(p), "."))
+	for _, e := range c.opts.Extensions {
+		if ext == strings.ToLower(strings.TrimPrefix(e, ".")) {
+			return true
+		}
+	}
+	return false
+}
+
+// included returns true if `p` matches one of the `Include` patterns, or if no
+// patterns are given.  Patterns containing a slash are matched against the
+// slash separated path relative to the local directory, others against the
+// base name.  Directories are always included so that the files inside them
+// are still considered.
+func (c *Client) included(p string) bool {
+	if len(c.opts.Include) == 0 {
+		return true
+	}
+	if fi, err := os.Stat(p); err == nil && fi.IsDir() {
+		return true
+	}
+
+	rel, base := filepath.ToSlash(c.relPath(p)), filepath.Base(p)
+	for _, pattern := range c.opts.Include {
+		name := base
+		if strings.Contains(pattern, "/") {
+			name = rel
+		}
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// hidden returns true if `p`, or any directory between it and the local
+// directory, is a dotfile or, with `ExcludeVCS`, version control metadata.
+// Walks skip hidden directories rather than descending into them.
+func (c *Client) hidden(p string) bool {
+	rel := c.relPath(p)
+	if rel == "." {
+		return false
+	}
+	for _, part := range strings.Split(rel, string(filepath.Separator)) {
+		if strings.HasPrefix(part, ".") || (c.opts.ExcludeVCS && vcsDirs[part]) {
+			return true
+		}
+	}
+	return false
+}
+
+// ignored returns true if the local path `p` should never be synced.
+func (c *Client) ignored(p string) bool {
+	if len(c.localFile) > 0 {
+		return p != c.localFile
+	}
+	if !c.included(p) {
+		return true
+	}
+	if c.hidden(p) {
+		return true
+	}
+	if !c.opts.SyncEditorTemp && isEditorTemp(p) {
+		return true
+	}
+	if len(c.opts.Extensions) > 0 && !c.hasExtension(p) {
+		return true
+	}
+	return false
+}
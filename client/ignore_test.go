@@ -0,0 +1,112 @@
+package client
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+func TestHiddenNested(t *testing.T) {
+	// The local directory may itself be hidden, only what is below it counts.
+	local := filepath.Join(t.TempDir(), ".config", "app")
+	if err := os.MkdirAll(local, 0755); err != nil {
+		t.Fatal(err)
+	}
+	c := newLocalClient(t, local, "/srv/app", Options{})
+
+	for _, tc := range []struct {
+		rel    string
+		hidden bool
+	}{
+		{".", false},
+		{"a.txt", false},
+		{"src/main.go", false},
+		{".env", true},
+		{"src/.env", true},
+		{".cache/a.txt", true},
+		{"a/b/.cache", true},
+		{"a/b/.cache/c/d.txt", true},
+		{"a/.b/c/d.txt", true},
+		{"a/b.c/d.txt", false},
+		{"a/b./c.txt", false},
+	} {
+		p := filepath.Join(local, filepath.FromSlash(tc.rel))
+		if got := c.hidden(p); got != tc.hidden {
+			t.Errorf("hidden(%q) = %v, want %v", tc.rel, got, tc.hidden)
+		}
+		if got := c.ignored(p); tc.rel != "." && got != tc.hidden {
+			t.Errorf("ignored(%q) = %v, want %v", tc.rel, got, tc.hidden)
+		}
+	}
+}
+
+func TestLocalTreeSkipsNestedHidden(t *testing.T) {
+	local := t.TempDir()
+	for _, rel := range []string{
+		"a.txt",
+		"src/main.go",
+		"src/.env",
+		"src/.cache/obj/x.o",
+		"src/pkg/.idea/workspace.xml",
+		".hidden/a.txt",
+	} {
+		p := filepath.Join(local, filepath.FromSlash(rel))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(rel), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c := newLocalClient(t, local, "/srv/app", Options{})
+	files, dirs, err := c.localTree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := []string{}
+	for _, p := range append(files, dirs...) {
+		got = append(got, filepath.ToSlash(c.relPath(p)))
+	}
+	sort.Strings(got)
+
+	// src/pkg has only a hidden directory inside it, so it is empty.
+	want := []string{"a.txt", "src/main.go", "src/pkg"}
+	if len(got) != len(want) {
+		t.Fatalf("localTree() = %q, want %q", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("localTree() = %q, want %q", got, want)
+		}
+	}
+}
+
+func TestHiddenExcludeVCS(t *testing.T) {
+	local := t.TempDir()
+	for _, tc := range []struct {
+		rel             string
+		hidden, withVCS bool
+	}{
+		{"CVS", false, true},
+		{"src/CVS/Entries", false, true},
+		{"a/_darcs/b", false, true},
+		{"a/.git/config", true, true},
+		{"a/CVSROOT/b", false, false},
+		{"src/main.go", false, false},
+	} {
+		p := filepath.Join(local, filepath.FromSlash(tc.rel))
+		for _, vcs := range []bool{false, true} {
+			c := newLocalClient(t, local, "/srv/app", Options{ExcludeVCS: vcs})
+			want := tc.hidden
+			if vcs {
+				want = tc.withVCS
+			}
+			if got := c.hidden(p); got != want {
+				t.Errorf("hidden(%q) with ExcludeVCS=%v = %v, want %v", tc.rel, vcs, got, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package client
+
+import "sync"
+
+////////////////////////////////////////////////////////////////////////////////
+
+// inFlight tracks the remote paths which are being transferred, so that a
+// change to a path while it is being transferred does not start a second,
+// racing, transfer.  Instead the change is noted and the path is transferred
+// once more after the current transfer completes.  The zero value is ready to
+// use.
+type inFlight struct {
+	lock  sync.Mutex
+	paths map[string]bool // remote path -> a follow-up transfer is wanted
+}
+
+// start marks `remote` as being transferred and returns true, or returns false
+// if it already is, in which case a follow-up transfer is requested instead.
+func (f *inFlight) start(remote string) bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.paths == nil {
+		f.paths = map[string]bool{}
+	}
+	if _, ok := f.paths[remote]; ok {
+		f.paths[remote] = true
+		return false
+	}
+	f.paths[remote] = false
+	return true
+}
+
+// done is called when the transfer of `remote` completes.  It returns true if
+// a follow-up transfer was requested, in which case `remote` stays in flight
+// for it, and false once the path is no longer being transferred.
+func (f *inFlight) done(remote string) bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.paths[remote] {
+		f.paths[remote] = false
+		return true
+	}
+	delete(f.paths, remote)
+	return false
+}
@@ -0,0 +1,99 @@
+package client
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+
+const (
+	// DefaultKeepAlive is the default interval between keepalive requests.
+	DefaultKeepAlive = 30 * time.Second
+
+	// tcpKeepAlive is the interval between TCP keepalive probes on the
+	// connection, so that the kernel notices a dead peer even when
+	// ssh keepalives are disabled.
+	tcpKeepAlive = 15 * time.Second
+
+	// aliveTimeout is how long `IsAlive` waits for the server to answer.
+	aliveTimeout = 2 * time.Second
+)
+
+// dialSSH connects to `addr` like `ssh.Dial`, but with TCP keepalives enabled
+// on the socket.
+func dialSSH(addr string, config *ssh.ClientConfig) (*ssh.Client, error) {
+	d := net.Dialer{Timeout: config.Timeout, KeepAlive: tcpKeepAlive}
+	conn, err := d.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	sc, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return ssh.NewClient(sc, chans, reqs), nil
+}
+
+// IsAlive returns true if the connection to the remote answers a keepalive
+// request within a couple of seconds.  It returns false while the client is
+// reconnecting, and once it is closed.  Containers have no connection to
+// probe, so for them it only reports whether the client is open.
+func (c *Client) IsAlive() bool {
+	if c.ctx.Err() != nil || c.reconnecting() != nil {
+		return false
+	}
+	if c.target != nil {
+		return true
+	}
+	return ping(c.conn(), aliveTimeout) == nil
+}
+
+// keepAlive sends a keepalive request on `conn` every `interval` until the
+// client is closed.  If the server does not answer within an interval the
+// connection is closed, which `watchConnection` reports as lost.
+func (c *Client) keepAlive(conn *ssh.Client, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-t.C:
+		}
+
+		if err := ping(conn, interval); err != nil {
+			// An EOF means the connection is already closed, which
+			// `watchConnection` reports.
+			if err != io.EOF {
+				c.status(fmt.Sprintf("Keepalive failed: %s", err.Error()))
+			}
+			conn.Close()
+			return
+		}
+	}
+}
+
+// ping sends a single keepalive request on `conn` and waits up to `timeout`
+// for the reply.  Servers which do not know the request still reply with a
+// failure, which is enough to know that the connection is alive.
+func ping(conn *ssh.Client, timeout time.Duration) error {
+	errc := make(chan error, 1)
+	go func() {
+		_, _, err := conn.SendRequest("keepalive@openssh.com", true, nil)
+		errc <- err
+	}()
+
+	select {
+	case err := <-errc:
+		return err
+	case <-time.After(timeout):
+		return fmt.Errorf("no keepalive response in %s", timeout)
+	}
+}
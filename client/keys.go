@@ -0,0 +1,101 @@
+package client
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"golang.org/x/crypto/ssh"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+
+// The vendored ssh package only understands rsa and ed25519 keys in the
+// "openssh-key-v1" format, which is what ssh-keygen writes by default.  This
+// fills in unencrypted ecdsa keys, see PROTOCOL.key in openssh-portable.
+
+// isUnhandledKeyTypeError returns true if `err` is the error returned when
+// parsing an openssh format key of a type the ssh package does not know.
+func isUnhandledKeyTypeError(err error) bool {
+	return err != nil && err.Error() == "ssh: unhandled key type"
+}
+
+// isOpenSSHKey returns true if `pemBytes` is a private key in the openssh
+// format, rather than the older PEM formats.
+func isOpenSSHKey(pemBytes []byte) bool {
+	block, _ := pem.Decode(pemBytes)
+	return block != nil && block.Type == "OPENSSH PRIVATE KEY"
+}
+
+// parseOpenSSHECDSAKey parses an unencrypted ecdsa private key in the openssh
+// format.
+func parseOpenSSHECDSAKey(pemBytes []byte) (ssh.Signer, error) {
+	block, _ := pem.Decode(pemBytes)
+	if block == nil || block.Type != "OPENSSH PRIVATE KEY" {
+		return nil, errors.New("ssh: not an openssh private key")
+	}
+
+	magic := append([]byte("openssh-key-v1"), 0)
+	if !bytes.HasPrefix(block.Bytes, magic) {
+		return nil, errors.New("ssh: invalid openssh private key format")
+	}
+
+	var w struct {
+		CipherName   string
+		KdfName      string
+		KdfOpts      string
+		NumKeys      uint32
+		PubKey       []byte
+		PrivKeyBlock []byte
+	}
+	if err := ssh.Unmarshal(block.Bytes[len(magic):], &w); err != nil {
+		return nil, err
+	}
+	if w.KdfName != "none" || w.CipherName != "none" {
+		return nil, errors.New("ssh: cannot decode encrypted private keys")
+	}
+
+	var key struct {
+		Check1  uint32
+		Check2  uint32
+		Keytype string
+		Curve   string
+		Q       []byte
+		D       *big.Int
+		Comment string
+		Pad     []byte `ssh:"rest"`
+	}
+	if err := ssh.Unmarshal(w.PrivKeyBlock, &key); err != nil {
+		return nil, err
+	}
+	if key.Check1 != key.Check2 {
+		return nil, errors.New("ssh: checkint mismatch")
+	}
+
+	var curve elliptic.Curve
+	switch key.Curve {
+	case "nistp256":
+		curve = elliptic.P256()
+	case "nistp384":
+		curve = elliptic.P384()
+	case "nistp521":
+		curve = elliptic.P521()
+	default:
+		return nil, fmt.Errorf("ssh: unsupported key type %s", key.Keytype)
+	}
+
+	x, y := elliptic.Unmarshal(curve, key.Q)
+	if x == nil {
+		return nil, errors.New("ssh: invalid ecdsa public key")
+	}
+
+	pk := &ecdsa.PrivateKey{
+		PublicKey: ecdsa.PublicKey{Curve: curve, X: x, Y: y},
+		D:         key.D,
+	}
+	return ssh.NewSignerFromKey(pk)
+}
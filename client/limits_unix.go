@@ -0,0 +1,17 @@
+//go:build !windows
+// +build !windows
+
+package client
+
+import "syscall"
+
+// DefaultMaxOpenFiles returns the default limit on the number of local files
+// which are open for transfer at once.  This is a quarter of the soft
+// RLIMIT_NOFILE, which leaves plenty of descriptors for everything else.
+func DefaultMaxOpenFiles() int {
+	var rlim syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rlim); err != nil || rlim.Cur < 4 {
+		return 64
+	}
+	return int(rlim.Cur / 4)
+}
@@ -0,0 +1,10 @@
+//go:build windows
+// +build windows
+
+package client
+
+// DefaultMaxOpenFiles returns the default limit on the number of local files
+// which are open for transfer at once.
+func DefaultMaxOpenFiles() int {
+	return 64
+}
@@ -0,0 +1,79 @@
+package client
+
+import (
+	"encoding/json"
+	"time"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+
+// logEntry is a single line of the `LogJSON` output.
+type logEntry struct {
+	Time       time.Time `json:"time"`
+	Host       string    `json:"host,omitempty"`
+	Event      string    `json:"event"`
+	Path       string    `json:"path,omitempty"`
+	RemotePath string    `json:"remote_path,omitempty"`
+	Bytes      int64     `json:"bytes,omitempty"`
+	DurationMs int64     `json:"duration_ms"`
+	Message    string    `json:"message,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	Summary    *Stats    `json:"summary,omitempty"`
+}
+
+// logJSON writes `e` as a line of JSON to stdout, with paths and messages
+// redacted if requested.  With `Quiet` only entries with an error are written.
+func (c *Client) logJSON(e logEntry) {
+	if c.opts.Quiet && len(e.Error) == 0 {
+		return
+	}
+	e.Time = time.Now().UTC()
+	e.Host = c.label
+	e.Path = c.redact(e.Path)
+	e.RemotePath = c.redact(e.RemotePath)
+	e.Message = c.redact(e.Message)
+	e.Error = c.redact(e.Error)
+
+	bs, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	// The leading carriage return is JSON whitespace, and keeps the line
+	// intact while the terminal is in raw mode.
+	stdoutStatus.println(string(bs))
+}
+
+// logResult records the outcome of `event` on `path`, which started at
+// `start`, in the client's `Stats` and, when `LogJSON` is set, the log.
+func (c *Client) logResult(event, path, remotePath string, bytes int64, start time.Time, err error) {
+	c.stats.add(event, bytes, err)
+	if !c.opts.LogJSON {
+		return
+	}
+
+	e := logEntry{
+		Event:      event,
+		Path:       path,
+		RemotePath: remotePath,
+		Bytes:      bytes,
+		DurationMs: int64(time.Since(start) / time.Millisecond),
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	c.logJSON(e)
+}
+
+// textStatus draws `msg` in place on the status line, unless `Quiet` is set or
+// `LogJSON` is, in which case the same information is logged by `logResult`
+// instead.  With `DryRun` the messages are what was asked for, so each gets
+// its own line.
+func (c *Client) textStatus(msg string) {
+	switch {
+	case c.opts.LogJSON, c.opts.Quiet:
+	case c.opts.DryRun:
+		c.status(msg)
+	default:
+		stdoutStatus.transient(c.redact(c.labelled(msg)))
+	}
+}
@@ -0,0 +1,130 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+
+// manifestFile is the name of the manifest stored in the remote directory.
+const manifestFile = ".pssh-manifest.json"
+
+// manifestVersion is bumped whenever the manifest schema changes.
+const manifestVersion = 1
+
+// Manifest records every file synced during a run.
+type Manifest struct {
+	Version   int             `json:"version"`
+	Created   time.Time       `json:"created"`
+	LocalDir  string          `json:"local_dir"`
+	RemoteDir string          `json:"remote_dir"`
+	Files     []ManifestEntry `json:"files"`
+}
+
+// ManifestEntry describes a single synced file.
+type ManifestEntry struct {
+	Path       string `json:"path"`        // relative to `LocalDir`
+	RemotePath string `json:"remote_path"` // absolute remote path
+	Size       int64  `json:"size"`        // size in bytes
+	Mode       string `json:"mode"`        // octal permissions, ex: "0644"
+	SHA256     string `json:"sha256"`      // hex encoded hash of the contents
+}
+
+// unsafeFileChars matches the characters of an address which are replaced to
+// use it in a file name.
+var unsafeFileChars = regexp.MustCompile(`[^A-Za-z0-9@._-]+`)
+
+// targetManifestPath returns the local manifest path for the target `addr`
+// and `remoteDir` when there are several targets, by adding them before the
+// extension of `p`.  For example `out.json` becomes `out.user@web1.json`.
+func targetManifestPath(p, addr, remoteDir string) string {
+	name := withoutPassword(addr)
+	if len(remoteDir) > 0 {
+		name += ":" + remoteDir
+	}
+	name = strings.Trim(unsafeFileChars.ReplaceAllString(name, "_"), "_")
+
+	ext := filepath.Ext(p)
+	return strings.TrimSuffix(p, ext) + "." + name + ext
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// recordManifest adds the just synced local file `f` to the manifest.
+func (c *Client) recordManifest(f *os.File, local, remote string) error {
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	sum, err := hashFile(f)
+	if err != nil {
+		return err
+	}
+
+	c.manifestLock.Lock()
+	defer c.manifestLock.Unlock()
+
+	if c.manifest == nil {
+		c.manifest = map[string]ManifestEntry{}
+	}
+	c.manifest[remote] = ManifestEntry{
+		Path:       filepath.ToSlash(c.relPath(local)),
+		RemotePath: remote,
+		Size:       stat.Size(),
+		Mode:       c.remotePerms(local, stat),
+		SHA256:     sum,
+	}
+	return nil
+}
+
+// writeManifest writes the manifest to the local `Manifest` path and to the
+// remote directory.
+func (c *Client) writeManifest() error {
+	c.manifestLock.Lock()
+	m := Manifest{
+		Version:   manifestVersion,
+		Created:   time.Now().UTC(),
+		LocalDir:  c.localDir,
+		RemoteDir: c.remoteDir,
+		Files:     []ManifestEntry{},
+	}
+	for _, e := range c.manifest {
+		m.Files = append(m.Files, e)
+	}
+	c.manifestLock.Unlock()
+
+	sort.Slice(m.Files, func(i, j int) bool {
+		return m.Files[i].Path < m.Files[j].Path
+	})
+
+	bs, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(c.opts.Manifest, bs, 0644); err != nil {
+		return err
+	}
+
+	if c.opts.DryRun {
+		return nil
+	}
+
+	remote := path.Join(c.remoteDir, manifestFile)
+	if err := c.ensureRemoteDirectory(remote); err != nil {
+		return err
+	}
+	return c.upload(bytes.NewReader(bs), remote, "0644", int64(len(bs)))
+}
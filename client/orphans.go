@@ -0,0 +1,139 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+
+// remoteFileList returns the slash separated paths, relative to the remote
+// directory, of the regular files on the remote.  It is listed over sftp if
+// there is a session, and with `find` otherwise.
+func (c *Client) remoteFileList() ([]string, error) {
+	if sc := c.sftpSession(); sc != nil {
+		files, err := c.remoteFiles(sc)
+		if err != nil {
+			return nil, err
+		}
+		rels := []string{}
+		for rel := range files {
+			rels = append(rels, rel)
+		}
+		return rels, nil
+	}
+
+	if c.opts.RemoteOS == RemoteOSWindows {
+		return nil, errors.New("listing the remote requires sftp on windows")
+	}
+	depth := ""
+	if !c.recursive {
+		depth = " -maxdepth 1"
+	}
+	out, err := c.runRemoteCommandOutput(fmt.Sprintf("find %s%s -type f", shellQuote(c.remoteDir), depth))
+	if err != nil {
+		return nil, err
+	}
+
+	rels := []string{}
+	prefix := strings.TrimSuffix(c.remoteDir, "/") + "/"
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		if p := scanner.Text(); strings.HasPrefix(p, prefix) {
+			rels = append(rels, strings.TrimPrefix(p, prefix))
+		}
+	}
+	return rels, scanner.Err()
+}
+
+// orphans returns the remote paths of the files on the remote which have no
+// local counterpart in `files`, the local files being synced.  Remote files
+// which would be ignored locally, or which no local path maps to, are left
+// alone.
+func (c *Client) orphans(files []string) ([]string, error) {
+	rels, err := c.remoteFileList()
+	if err != nil {
+		return nil, err
+	}
+
+	local := map[string]bool{}
+	for _, f := range files {
+		local[c.remoteRel(filepath.ToSlash(c.relPath(f)))] = true
+	}
+
+	ret := []string{}
+	for _, rel := range rels {
+		if !local[rel] && !c.remoteIgnored(rel) {
+			ret = append(ret, path.Join(c.remoteDir, rel))
+		}
+	}
+	sort.Strings(ret)
+	return ret, nil
+}
+
+// remoteIgnored returns true if the file at the slash separated path `rel`,
+// relative to the remote directory, would not be synced from any local path
+// which maps to it, see `localRels`.
+func (c *Client) remoteIgnored(rel string) bool {
+	lrels := c.localRels(rel)
+	if len(lrels) == 0 {
+		return true
+	}
+	for _, lrel := range lrels {
+		if c.ignored(filepath.Join(c.localDir, filepath.FromSlash(lrel))) {
+			return true
+		}
+	}
+	return false
+}
+
+// pruneOrphans finds the remote files with no local counterpart in `files`
+// after the initial sync, for example because they were removed locally
+// while pssh was not running.  With `Delete` they are removed, otherwise they
+// are only reported.  It returns the number of orphans which could not be
+// removed.
+func (c *Client) pruneOrphans(files []string) int {
+	if len(c.localFile) > 0 {
+		return 0
+	}
+
+	orphans, err := c.orphans(files)
+	if err != nil {
+		c.status(fmt.Sprintf("Warning: unable to list the remote to look for orphaned files (%s)", err.Error()))
+		return 0
+	}
+	if len(orphans) == 0 {
+		return 0
+	}
+
+	if !c.opts.Delete {
+		for _, p := range orphans {
+			c.status(fmt.Sprintf("Orphaned: %s", p))
+		}
+		c.status(fmt.Sprintf("Warning: %d remote files have no local copy, see -delete", len(orphans)))
+		return 0
+	}
+
+	failed := 0
+	for _, p := range orphans {
+		if c.ctx.Err() != nil {
+			break
+		}
+		start := time.Now()
+		c.textStatus(fmt.Sprintf("Remove orphan: %s", p))
+		err := c.removeRemotePath(p)
+		if err != nil {
+			c.syncError(p, err)
+			failed++
+		}
+		c.logResult("remove", "", p, 0, start, err)
+	}
+	return failed
+}
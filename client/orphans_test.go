@@ -0,0 +1,57 @@
+package client
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPruneOrphansRemapped(t *testing.T) {
+	local, remote := t.TempDir(), t.TempDir()
+	write := func(root, rel string) {
+		p := filepath.Join(root, filepath.FromSlash(rel))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(rel), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(local, "src/kept.go")
+	write(local, "src/gone.go")
+	write(remote, "dist/kept.go")
+	write(remote, "dist/gone.go")
+	write(remote, "dist/old.go")
+	write(remote, "dist/.env")
+	write(remote, "dist/gone.go.swp")
+	write(remote, "outside.go")
+	if err := os.Remove(filepath.Join(local, "src", "gone.go")); err != nil {
+		t.Fatal(err)
+	}
+
+	c := newLocalClient(t, local, remote, Options{StripPrefix: "src", AddPrefix: "dist", Delete: true})
+	files, err := c.localFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if failed := c.pruneOrphans(files); failed != 0 {
+		t.Fatalf("%d orphans could not be removed", failed)
+	}
+
+	for rel, want := range map[string]bool{
+		"dist/kept.go": true,
+		"dist/gone.go": false,
+		"dist/old.go":  false,
+		// Ignored locally, as a hidden file or editor swap file.
+		"dist/.env":        true,
+		"dist/gone.go.swp": true,
+		// No local path maps outside of the added prefix.
+		"outside.go": true,
+	} {
+		_, err := os.Stat(filepath.Join(remote, filepath.FromSlash(rel)))
+		if got := err == nil; got != want {
+			t.Errorf("%s exists = %v, want %v", rel, got, want)
+		}
+	}
+}
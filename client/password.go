@@ -0,0 +1,51 @@
+package client
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+
+// PasswordEnv names the environment variable which holds the password to
+// authenticate with, for automated runs where there is no one to prompt.
+const PasswordEnv = "PSSH_PASSWORD"
+
+// stdinPassword is the password read from stdin, which can only be read once
+// however many hosts need it.  It is guarded by `promptLock`.
+var stdinPassword *string
+
+// passwordFor returns the password for `user@host`.  It is taken from
+// `PasswordEnv` if that is set, otherwise from the first line of stdin when
+// stdin is not a terminal (ex: `echo $PASS | pssh ...`), and only otherwise
+// prompted for.
+func passwordFor(user, host string, log verboseLogger) (string, error) {
+	if pass := os.Getenv(PasswordEnv); len(pass) > 0 {
+		log.printf(1, "Using the password from $%s", PasswordEnv)
+		return pass, nil
+	}
+
+	promptLock.Lock()
+	defer promptLock.Unlock()
+
+	if !terminal.IsTerminal(stdinFd()) {
+		if stdinPassword == nil {
+			log.printf(1, "Reading the password from stdin")
+			line, err := stdinReader.ReadString('\n')
+			if err != nil && len(line) == 0 {
+				return "", fmt.Errorf("unable to read the password from stdin: %s", err.Error())
+			}
+			pass := strings.TrimRight(line, "\r\n")
+			stdinPassword = &pass
+		}
+		return *stdinPassword, nil
+	}
+
+	fmt.Printf("%s@%s's password: ", user, host)
+	bs, err := readPassword()
+	fmt.Printf("\n")
+	return string(bs), err
+}
@@ -0,0 +1,88 @@
+package client
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sync"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+
+// runPostCmd runs `PostCmd` on the remote, printing each line of its output as
+// a status line, and returns an error if it fails or exits non-zero.
+func (c *Client) runPostCmd() error {
+	cmd := c.opts.PostCmd
+	if c.opts.DryRun {
+		c.status(fmt.Sprintf("[dry-run] run %s", cmd))
+		return nil
+	}
+
+	sess, err := c.newSession()
+	if err != nil {
+		return err
+	}
+	defer c.closeSession(sess)
+
+	stdout, err := sess.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	stderr, err := sess.StderrPipe()
+	if err != nil {
+		return err
+	}
+
+	c.status(fmt.Sprintf("Running post-cmd: %s", cmd))
+	if err := sess.Start(cmd); err != nil {
+		return err
+	}
+
+	var wg sync.WaitGroup
+	for _, r := range []io.Reader{stdout, stderr} {
+		wg.Add(1)
+		go func(r io.Reader) {
+			defer wg.Done()
+			scanner := bufio.NewScanner(r)
+			for scanner.Scan() {
+				c.status(fmt.Sprintf("post-cmd :: %s", scanner.Text()))
+			}
+		}(r)
+	}
+	wg.Wait()
+
+	err = sess.Wait()
+	code, ok := exitStatus(err)
+	if !ok {
+		return err
+	}
+	c.status(fmt.Sprintf("post-cmd exited with status %d", code))
+	if code != 0 {
+		return fmt.Errorf("%q exited with status %d", cmd, code)
+	}
+	return nil
+}
+
+// afterChange runs `PostCmd` once the changes which were just synced have
+// settled, if `PostCmdOnChange` is set.  It runs in the background so that
+// changes are still synced meanwhile, and changes while it is running cause it
+// to run once more afterwards rather than running it twice at once.
+func (c *Client) afterChange() {
+	if len(c.opts.PostCmd) == 0 || !c.opts.PostCmdOnChange {
+		return
+	}
+	if !c.postCmds.start(c.opts.PostCmd) {
+		return
+	}
+
+	go func() {
+		for {
+			if err := c.runPostCmd(); err != nil {
+				c.syncError("post-cmd", err)
+			}
+			if !c.postCmds.done(c.opts.PostCmd) || c.ctx.Err() != nil {
+				return
+			}
+		}
+	}()
+}
@@ -0,0 +1,75 @@
+package client
+
+import (
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"time"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+
+const (
+	// progressMinSize is the smallest transfer which reports progress, any
+	// smaller finishes too quickly for it to be useful.
+	progressMinSize = 1024 * 1024
+
+	// progressInterval is the shortest time between progress updates.
+	progressInterval = 250 * time.Millisecond
+
+	// progressWidth is the number of characters in the progress bar.
+	progressWidth = 30
+)
+
+// progressReader counts the bytes read through it and redraws a progress bar
+// for the transfer of `name` on the status line.
+type progressReader struct {
+	r    io.Reader
+	name string
+	sz   int64
+	n    int64
+	last time.Time
+}
+
+func newProgressReader(r io.Reader, name string, sz int64) *progressReader {
+	return &progressReader{r: r, name: name, sz: sz}
+}
+
+func (p *progressReader) Read(bs []byte) (int, error) {
+	n, err := p.r.Read(bs)
+	p.n += int64(n)
+	if now := time.Now(); now.Sub(p.last) >= progressInterval {
+		p.last = now
+		p.draw()
+	}
+	return n, err
+}
+
+// draw redraws the progress bar in place.
+func (p *progressReader) draw() {
+	pct := 100
+	if p.sz > 0 && p.n < p.sz {
+		pct = int(p.n * 100 / p.sz)
+	}
+	done := pct * progressWidth / 100
+	bar := strings.Repeat("=", done) + strings.Repeat(" ", progressWidth-done)
+	stdoutStatus.transient(fmt.Sprintf("%s [%s] %3d%% %d/%d bytes", p.name, bar, pct, p.n, p.sz))
+}
+
+// finish draws the final state of the bar, which is left on the status line
+// until the next message.
+func (p *progressReader) finish() {
+	p.draw()
+}
+
+// withProgress wraps `src` to report progress for transfers of at least
+// `progressMinSize` bytes, when stdout is a terminal.  The returned function
+// draws the finished progress bar.
+func (c *Client) withProgress(src io.Reader, dstpath string, sz int64) (io.Reader, func()) {
+	if sz < progressMinSize || c.opts.LogJSON || c.opts.Quiet || !stdoutStatus.tty {
+		return src, func() {}
+	}
+	p := newProgressReader(src, c.redact(path.Base(dstpath)), sz)
+	return p, p.finish
+}
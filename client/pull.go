@@ -0,0 +1,174 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+
+	"github.com/pkg/sftp"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+
+// remoteFiles walks the remote directory over sftp and returns the attributes
+// of each regular file keyed by its slash separated path relative to the remote
+// directory.  Subdirectories are only walked if the client is recursive.
+func (c *Client) remoteFiles(sc *sftp.Client) (map[string]os.FileInfo, error) {
+	files := map[string]os.FileInfo{}
+
+	var walk func(rel string) error
+	walk = func(rel string) error {
+		entries, err := sc.ReadDir(path.Join(c.remoteDir, rel))
+		if err != nil {
+			return err
+		}
+		for _, fi := range entries {
+			p := path.Join(rel, fi.Name())
+			switch {
+			case fi.IsDir():
+				if c.recursive {
+					if err := walk(p); err != nil {
+						return err
+					}
+				}
+			case fi.Mode().IsRegular():
+				files[p] = fi
+			}
+		}
+		return nil
+	}
+	return files, walk("")
+}
+
+// localUpToDate returns true if the local file at `p` has the same size and
+// modification time as the remote file described by `remote`.
+func localUpToDate(p string, remote os.FileInfo) bool {
+	fi, err := os.Stat(p)
+	if err != nil || !fi.Mode().IsRegular() {
+		return false
+	}
+	return fi.Size() == remote.Size() && fi.ModTime().Unix() == remote.ModTime().Unix()
+}
+
+// pullFile downloads the remote file `remote` to `local`.  The file is written
+// alongside `local` and renamed into place so that a failed transfer does not
+// leave a partial file behind.  Its mode and modification time are copied from
+// `fi` so that the next pull can tell it is up to date.
+func (c *Client) pullFile(sc *sftp.Client, remote, local string, fi os.FileInfo) error {
+	dir := filepath.Dir(local)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(dir, ".pssh-pull-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	src, err := sc.Open(remote)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	_, err = src.WriteTo(tmp)
+	src.Close()
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), fi.Mode().Perm()); err != nil {
+		return err
+	}
+	if err := os.Chtimes(tmp.Name(), fi.ModTime(), fi.ModTime()); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), local)
+}
+
+// Pull mirrors the remote directory into the local one, the reverse of
+// `SyncOnce`.  Remote files which are missing locally or differ in size or
+// modification time are downloaded, and local files which no longer exist on
+// the remote are removed.  Ignored files are left alone on both sides.  This
+// requires sftp on the remote.
+func (c *Client) Pull() error {
+	sc := c.sftpSession()
+	if sc == nil {
+		return errors.New("pull requires sftp on the remote")
+	}
+	if c.remapped() {
+		return errors.New("pull can not be combined with a strip or add prefix")
+	}
+
+	remote, err := c.remoteFiles(sc)
+	if err != nil {
+		return err
+	}
+	rels := []string{}
+	for rel := range remote {
+		if !c.ignored(filepath.Join(c.localDir, filepath.FromSlash(rel))) {
+			rels = append(rels, rel)
+		}
+	}
+	sort.Strings(rels)
+
+	c.status(fmt.Sprintf("Pull of %d files", len(rels)))
+	failed, pulled := 0, 0
+	for _, rel := range rels {
+		if err := c.ctx.Err(); err != nil {
+			return err
+		}
+
+		src := path.Join(c.remoteDir, rel)
+		dst := filepath.Join(c.localDir, filepath.FromSlash(rel))
+		if localUpToDate(dst, remote[rel]) {
+			continue
+		}
+		pulled++
+		if c.opts.DryRun {
+			c.status(fmt.Sprintf("[dry-run] pull %s --> %s", src, dst))
+			continue
+		}
+
+		c.status(fmt.Sprintf("Pull file: %s --> %s", src, dst))
+		if err := c.pullFile(sc, src, dst, remote[rel]); err != nil {
+			c.syncError(dst, err)
+			failed++
+		}
+	}
+
+	// Remove local files which are gone from the remote.
+	removeFailed := 0
+	files, err := c.localFiles()
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if _, ok := remote[filepath.ToSlash(c.relPath(f))]; ok {
+			continue
+		}
+		if c.opts.DryRun {
+			c.status(fmt.Sprintf("[dry-run] remove %s", f))
+			continue
+		}
+
+		c.status(fmt.Sprintf("Remove file: %s", f))
+		if err := os.Remove(f); err != nil {
+			c.syncError(f, err)
+			removeFailed++
+		}
+	}
+
+	c.status(fmt.Sprintf("Pull complete, %d of %d changed files pulled", pulled-failed, pulled))
+	if failed+removeFailed > 0 {
+		return fmt.Errorf("%d files failed to pull", failed+removeFailed)
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package client
+
+import (
+	"context"
+	"io"
+
+	"golang.org/x/time/rate"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+
+// newRateLimiter returns a limiter which caps the combined throughput of every
+// transfer it is applied to at `bps` bytes per second, or nil if the rate is
+// unlimited, see `Options.RateLimit`.  The burst is about a tenth of a
+// second's worth so that the rate stays smooth, and is also the most bytes
+// sent at once.
+func newRateLimiter(bps int64) *rate.Limiter {
+	if bps <= 0 {
+		return nil
+	}
+	burst := 1024
+	if n := bps / 10; n > int64(burst) {
+		burst = int(n)
+	}
+	return rate.NewLimiter(rate.Limit(bps), burst)
+}
+
+// limitedReader is an `io.Reader` which is throttled by a `rate.Limiter`.
+// Waiting stops with an error once `ctx` is cancelled.
+type limitedReader struct {
+	ctx context.Context
+	r   io.Reader
+	l   *rate.Limiter
+}
+
+func (r *limitedReader) Read(p []byte) (int, error) {
+	if max := r.l.Burst(); len(p) > max {
+		p = p[:max]
+	}
+	n, err := r.r.Read(p)
+	if n > 0 {
+		if werr := r.l.WaitN(r.ctx, n); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+// limitedWriter is an `io.Writer` which is throttled by a `rate.Limiter`.
+// Waiting stops with an error once `ctx` is cancelled.
+type limitedWriter struct {
+	ctx context.Context
+	w   io.Writer
+	l   *rate.Limiter
+}
+
+func (w *limitedWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := w.l.Burst()
+		if n > len(p) {
+			n = len(p)
+		}
+		if err := w.l.WaitN(w.ctx, n); err != nil {
+			return written, err
+		}
+		n, err := w.w.Write(p[:n])
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// throttle returns `r` limited to the client's `RateLimit`.
+func (c *Client) throttle(r io.Reader) io.Reader {
+	if c.limiter == nil {
+		return r
+	}
+	return &limitedReader{ctx: c.ctx, r: r, l: c.limiter}
+}
+
+// throttleWriter returns `w` limited to the client's `RateLimit`.
+func (c *Client) throttleWriter(w io.Writer) io.Writer {
+	if c.limiter == nil {
+		return w
+	}
+	return &limitedWriter{ctx: c.ctx, w: w, l: c.limiter}
+}
@@ -0,0 +1,178 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+
+const (
+	// DefaultMaxRetries is the default number of times to try to reconnect
+	// after the connection is lost.
+	DefaultMaxRetries = 10
+
+	// reconnectMinBackoff and reconnectMaxBackoff bound the wait between
+	// reconnection attempts, which doubles after each failure.
+	reconnectMinBackoff = time.Second
+	reconnectMaxBackoff = 30 * time.Second
+)
+
+// redialShared replaces the shared connection `dead` with a new one, unless
+// another `Client` sharing it has already done so.
+func redialShared(addr string, config *ssh.ClientConfig, dead *ssh.Client) (*ssh.Client, error) {
+	connsLock.Lock()
+	defer connsLock.Unlock()
+
+	key := config.User + "@" + addr
+	sc, ok := conns[key]
+	if !ok {
+		return nil, errors.New("connection released")
+	}
+	if sc.client != dead && !sc.closed {
+		return sc.client, nil
+	}
+
+	client, err := dialSSH(addr, config)
+	if err != nil {
+		return nil, err
+	}
+	sc.client, sc.closed = client, false
+	go watchShared(key, client)
+	return client, nil
+}
+
+// conn returns the current ssh connection.
+func (c *Client) conn() *ssh.Client {
+	c.connLock.RLock()
+	defer c.connLock.RUnlock()
+	return c.Client
+}
+
+// reconnecting returns a channel which is closed once the connection has been
+// re-established, or nil if the connection is up.
+func (c *Client) reconnecting() <-chan struct{} {
+	c.connLock.RLock()
+	defer c.connLock.RUnlock()
+	return c.down
+}
+
+// generation returns the number of times the client has reconnected.
+func (c *Client) generation() int {
+	c.connLock.RLock()
+	defer c.connLock.RUnlock()
+	return c.gen
+}
+
+// monitor watches `conn` for the rest of its life, sending keepalives if they
+// are enabled and reconnecting once it closes.
+func (c *Client) monitor(conn *ssh.Client) {
+	if c.opts.KeepAlive > 0 {
+		go c.keepAlive(conn, c.opts.KeepAlive)
+	}
+	go c.watchConnection(conn)
+}
+
+// watchConnection waits for `conn` to close and then tries to reconnect.
+func (c *Client) watchConnection(conn *ssh.Client) {
+	err := conn.Wait()
+	if c.ctx.Err() != nil {
+		return
+	}
+	if err == nil {
+		err = errors.New("connection closed")
+	}
+	c.connectionLost(conn, err)
+}
+
+// connectionLost redials the remote after `conn` failed with `err`, backing
+// off exponentially between attempts.  Events are held rather than synced
+// while the connection is down.  If the connection cannot be re-established
+// within `MaxRetries` attempts the client is shut down, see `Done` and `Err`.
+func (c *Client) connectionLost(conn *ssh.Client, err error) {
+	c.connLock.Lock()
+	c.down = make(chan struct{})
+	c.connLock.Unlock()
+
+	backoff := reconnectMinBackoff
+	for attempt := 1; attempt <= c.opts.MaxRetries; attempt++ {
+		c.status(fmt.Sprintf("Connection lost (%s), reconnecting in %s (attempt %d of %d)",
+			err.Error(), backoff, attempt, c.opts.MaxRetries))
+
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+
+		newConn, derr := redialShared(c.addr, c.config, conn)
+		if derr == nil {
+			c.resume(newConn)
+			return
+		}
+		err = derr
+
+		if backoff *= 2; backoff > reconnectMaxBackoff {
+			backoff = reconnectMaxBackoff
+		}
+	}
+
+	if c.opts.MaxRetries > 0 {
+		err = fmt.Errorf("%s, gave up after %d attempts", err.Error(), c.opts.MaxRetries)
+	}
+	c.fail(fmt.Errorf("connection lost: %s", err.Error()))
+}
+
+// resume switches the client over to `conn` once it has reconnected.
+func (c *Client) resume(conn *ssh.Client) {
+	c.connLock.Lock()
+	old := c.sftp
+	c.sftp = nil
+	c.Client = conn
+	c.connLock.Unlock()
+
+	if old != nil {
+		old.Close()
+		<-c.sessions
+	}
+
+	if err := c.openSFTP(); err != nil {
+		c.status(fmt.Sprintf("Warning: %s", err.Error()))
+	}
+	c.monitor(conn)
+
+	c.connLock.Lock()
+	c.gen++
+	close(c.down)
+	c.down = nil
+	c.connLock.Unlock()
+
+	c.status("Reconnected!")
+}
+
+// fail records `err` as the reason the client stopped and shuts it down.
+func (c *Client) fail(err error) {
+	c.loopLock.Lock()
+	defer c.loopLock.Unlock()
+
+	if c.ctx.Err() == nil {
+		c.connErr = err
+		c.cancel()
+	}
+}
+
+// Done returns a channel which is closed once the client stops, either
+// because it was closed or because the connection was lost.
+func (c *Client) Done() <-chan struct{} {
+	return c.ctx.Done()
+}
+
+// Err returns the reason the connection was lost, or nil if it was not.
+func (c *Client) Err() error {
+	c.loopLock.Lock()
+	defer c.loopLock.Unlock()
+	return c.connErr
+}
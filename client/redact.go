@@ -0,0 +1,40 @@
+package client
+
+import (
+	"os"
+	"regexp"
+	"strings"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+
+// secretPatterns match common credentials which should never be shown when
+// running with `Redact`.  Each match is replaced by `redactSecret`.
+var secretPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`(?i)\b(password|passwd|pwd|secret|token|api[_-]?key|access[_-]?key)(\s*[=:]\s*)\S+`),
+	regexp.MustCompile(`(?i)\b(bearer|basic)(\s+)[a-z0-9._~+/=-]+`),
+	regexp.MustCompile(`\b(AKIA)()[0-9A-Z]{16}\b`),
+	regexp.MustCompile(`(-----BEGIN [A-Z ]*PRIVATE KEY-----)()[\s\S]*?-----END [A-Z ]*PRIVATE KEY-----`),
+}
+
+const redactSecret = "${1}${2}****"
+
+// Redact replaces the home directory prefix of any paths in `s` with `~` and
+// masks anything that looks like a secret.
+func Redact(s string) string {
+	if home, err := os.UserHomeDir(); err == nil && len(home) > 1 {
+		s = strings.Replace(s, home, "~", -1)
+	}
+	for _, re := range secretPatterns {
+		s = re.ReplaceAllString(s, redactSecret)
+	}
+	return s
+}
+
+// redact scrubs `s` if the client was created with `Redact`.
+func (c *Client) redact(s string) string {
+	if !c.opts.Redact {
+		return s
+	}
+	return Redact(s)
+}
@@ -0,0 +1,74 @@
+package client
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+
+// checkRemap returns an error if `opts.AddPrefix` would place files outside
+// of the remote directory.
+func checkRemap(opts Options) error {
+	if len(opts.AddPrefix) == 0 {
+		return nil
+	}
+	p := path.Clean(opts.AddPrefix)
+	if path.IsAbs(p) || p == ".." || strings.HasPrefix(p, "../") {
+		return fmt.Errorf("add prefix %q must be a path inside the remote directory", opts.AddPrefix)
+	}
+	return nil
+}
+
+// remapped returns true if remote paths are not a mirror of local ones, see
+// `Options.StripPrefix`.
+func (c *Client) remapped() bool {
+	return len(c.opts.StripPrefix) > 0 || len(c.opts.AddPrefix) > 0
+}
+
+// remoteRel maps the slash separated path `rel`, relative to the local
+// directory, to its path relative to the remote directory.  `StripPrefix` is
+// removed from the front of paths which start with it, and then `AddPrefix`
+// is added to the front of every path.  Without either, `rel` is returned
+// as it is.
+func (c *Client) remoteRel(rel string) string {
+	if strip := strings.Trim(path.Clean("/"+c.opts.StripPrefix), "/"); len(strip) > 0 {
+		if rel == strip {
+			rel = ""
+		} else if strings.HasPrefix(rel, strip+"/") {
+			rel = rel[len(strip)+1:]
+		}
+	}
+	if len(c.opts.AddPrefix) > 0 {
+		rel = path.Join(c.opts.AddPrefix, rel)
+	}
+	return rel
+}
+
+// localRels returns the slash separated paths, relative to the local
+// directory, which `remoteRel` maps to `rel`.  With `StripPrefix` there may be
+// two: the path under the prefix, and `rel` itself if it does not start with
+// the prefix.  There are none if `rel` is outside of `AddPrefix`.
+func (c *Client) localRels(rel string) []string {
+	if len(c.opts.AddPrefix) > 0 {
+		add := path.Clean(c.opts.AddPrefix)
+		if rel == add {
+			rel = ""
+		} else if strings.HasPrefix(rel, add+"/") {
+			rel = rel[len(add)+1:]
+		} else if add != "." {
+			return nil
+		}
+	}
+
+	strip := strings.Trim(path.Clean("/"+c.opts.StripPrefix), "/")
+	if len(strip) == 0 {
+		return []string{rel}
+	}
+	rels := []string{path.Join(strip, rel)}
+	if rel != strip && !strings.HasPrefix(rel, strip+"/") {
+		rels = append(rels, rel)
+	}
+	return rels
+}
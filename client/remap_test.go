@@ -0,0 +1,111 @@
+package client
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestRemotePathFor(t *testing.T) {
+	local := t.TempDir()
+	for _, tc := range []struct {
+		strip, add string
+		rel        string
+		remote     string
+	}{
+		{"", "", "a.txt", "/srv/app/a.txt"},
+		{"", "", "src/a.txt", "/srv/app/src/a.txt"},
+		{"src", "", "src/foo/bar.js", "/srv/app/foo/bar.js"},
+		{"src", "", "src", "/srv/app"},
+		{"src", "", "srcs/a.txt", "/srv/app/srcs/a.txt"},
+		{"src", "", "lib/a.txt", "/srv/app/lib/a.txt"},
+		{"/src/", "", "src/a.txt", "/srv/app/a.txt"},
+		{"src/foo", "", "src/foo/bar.js", "/srv/app/bar.js"},
+		{"", "dist", "a.txt", "/srv/app/dist/a.txt"},
+		{"", "dist/", "src/a.txt", "/srv/app/dist/src/a.txt"},
+		{"src/foo", "dist", "src/foo/bar.js", "/srv/app/dist/bar.js"},
+		{"src", "dist", "lib/a.txt", "/srv/app/dist/lib/a.txt"},
+	} {
+		c := newLocalClient(t, local, "/srv/app", Options{StripPrefix: tc.strip, AddPrefix: tc.add})
+		got, err := c.remotePathFor(filepath.Join(c.localDir, filepath.FromSlash(tc.rel)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tc.remote {
+			t.Errorf("remotePathFor(%q) with strip %q add %q = %q, want %q", tc.rel, tc.strip, tc.add, got, tc.remote)
+		}
+	}
+}
+
+func TestLocalRels(t *testing.T) {
+	local := t.TempDir()
+	for _, tc := range []struct {
+		strip, add string
+		rel        string
+		want       []string
+	}{
+		{"", "", "a.txt", []string{"a.txt"}},
+		{"src", "", "foo/bar.js", []string{"src/foo/bar.js", "foo/bar.js"}},
+		// A local path starting with the prefix would have been stripped,
+		// so only the path under the prefix maps here.
+		{"src", "", "src/a.txt", []string{"src/src/a.txt"}},
+		{"", "dist", "dist/a.txt", []string{"a.txt"}},
+		{"", "dist", "other/a.txt", nil},
+		{"", "dist", "distx/a.txt", nil},
+		{"src/foo", "dist", "dist/bar.js", []string{"src/foo/bar.js", "bar.js"}},
+		{"src", "dist", "a.txt", nil},
+	} {
+		c := newLocalClient(t, local, "/srv/app", Options{StripPrefix: tc.strip, AddPrefix: tc.add})
+		got := c.localRels(tc.rel)
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("localRels(%q) with strip %q add %q = %q, want %q", tc.rel, tc.strip, tc.add, got, tc.want)
+		}
+	}
+}
+
+func TestLocalRelsInvertsRemoteRel(t *testing.T) {
+	local := t.TempDir()
+	for _, opts := range []Options{
+		{},
+		{StripPrefix: "src"},
+		{AddPrefix: "dist"},
+		{StripPrefix: "src/foo", AddPrefix: "dist/web"},
+	} {
+		c := newLocalClient(t, local, "/srv/app", opts)
+		for _, rel := range []string{"a.txt", "src/a.txt", "src/foo/bar.js", "srcs/a.txt", "lib/src/a.txt"} {
+			found := false
+			for _, lrel := range c.localRels(c.remoteRel(rel)) {
+				if lrel == rel {
+					found = true
+				}
+				if back := c.remoteRel(lrel); back != c.remoteRel(rel) {
+					t.Errorf("remoteRel(%q) = %q, but it is an inverse of %q", lrel, back, c.remoteRel(rel))
+				}
+			}
+			if !found {
+				t.Errorf("localRels(remoteRel(%q)) with %+v = %q, does not include it",
+					rel, opts, c.localRels(c.remoteRel(rel)))
+			}
+		}
+	}
+}
+
+func TestCheckRemap(t *testing.T) {
+	for _, tc := range []struct {
+		add string
+		ok  bool
+	}{
+		{"", true},
+		{"dist", true},
+		{"dist/web/", true},
+		{"a/../b", true},
+		{"/dist", false},
+		{"..", false},
+		{"../dist", false},
+		{"a/../../dist", false},
+	} {
+		if err := checkRemap(Options{AddPrefix: tc.add}); (err == nil) != tc.ok {
+			t.Errorf("checkRemap(%q) = %v, want ok=%v", tc.add, err, tc.ok)
+		}
+	}
+}
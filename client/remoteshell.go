@@ -0,0 +1,266 @@
+package client
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+
+// Remote operating systems, see `Options.RemoteOS`.
+const (
+	RemoteOSPOSIX   = "posix"   // any remote with a POSIX shell and utilities
+	RemoteOSWindows = "windows" // windows OpenSSH, with cmd or PowerShell as the shell
+)
+
+// The most bytes of arguments put into one command by `batchCommands`.  Linux
+// limits a single argument, such as the command given to `sh -c`, to 128KB,
+// and cmd limits the whole command line to 8191 characters.
+const (
+	posixMaxArgs   = 64 * 1024
+	windowsMaxArgs = 6 * 1024
+)
+
+// batchCommands splits the quoted `args` into as few commands as keep the
+// arguments of each, joined by `sep`, within `max` bytes.  Each command is
+// built by `cmd` from its joined arguments.
+func batchCommands(args []string, sep string, max int, cmd func(args string) string) []string {
+	ret := []string{}
+	start, n := 0, 0
+	for i, a := range args {
+		if i > start && n+len(sep)+len(a) > max {
+			ret = append(ret, cmd(strings.Join(args[start:i], sep)))
+			start, n = i, 0
+		}
+		if n > 0 {
+			n += len(sep)
+		}
+		n += len(a)
+	}
+	if start < len(args) {
+		ret = append(ret, cmd(strings.Join(args[start:], sep)))
+	}
+	return ret
+}
+
+// remoteShell builds the commands run on the remote to manage files, in the
+// syntax of the remote's shell.  Transfers themselves go over sftp or scp,
+// these are only needed around them.
+type remoteShell interface {
+	// mkdirAll creates `dir` and any missing parents.
+	mkdirAll(dir string) string
+	// remove removes the file `p`, and succeeds if it does not exist.
+	remove(p string) string
+	// rename moves `from` to `to`, replacing anything already there.
+	rename(from, to string) string
+	// touch sets the modification time of `p` to `mtime`.
+	touch(p string, mtime time.Time) string
+	// chmod sets the permissions of `p` to the octal `perms`.
+	chmod(p, perms string) string
+	// writeTest creates `dir` and checks that a file can be created in it.
+	writeTest(dir string) string
+	// now prints the current time in seconds since the epoch.
+	now() string
+	// home prints the home directory of the remote user.
+	home() string
+	// checksums prints "<sha256>  <path>" for each file under `dir`, where
+	// the path is `dir` and the slash separated path below it.  A missing
+	// `dir` prints nothing.
+	checksums(dir string) string
+	// fileChecksums prints "<sha256>  <path>" for each of `paths` which is a
+	// file.  There may be several commands, to keep each within the limits
+	// of the remote's command line.
+	fileChecksums(paths []string) []string
+	// scpSink runs the `scp` sink, which receives files into `dir`.
+	scpSink(scp, dir string) string
+}
+
+// newRemoteShell returns the `remoteShell` for the remote operating system
+// `os`, an empty `os` is POSIX.
+func newRemoteShell(os string) (remoteShell, error) {
+	switch os {
+	case "", RemoteOSPOSIX:
+		return posixShell{}, nil
+	case RemoteOSWindows:
+		return windowsShell{}, nil
+	}
+	return nil, fmt.Errorf("unknown remote os %q, expected %s or %s", os, RemoteOSPOSIX, RemoteOSWindows)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// posixShell builds commands for a POSIX `sh`.
+type posixShell struct{}
+
+func (posixShell) mkdirAll(dir string) string {
+	return fmt.Sprintf("mkdir -p %s", shellQuote(dir))
+}
+
+func (posixShell) remove(p string) string {
+	// `rm -f` succeeds even if the remote file is already gone.
+	return fmt.Sprintf("rm -f %s", shellQuote(p))
+}
+
+func (posixShell) rename(from, to string) string {
+	return fmt.Sprintf("mv -f %s %s", shellQuote(from), shellQuote(to))
+}
+
+func (posixShell) touch(p string, mtime time.Time) string {
+	// `touch -t` is POSIX, unlike `touch -d @seconds`.
+	stamp := mtime.UTC().Format("200601021504.05")
+	return fmt.Sprintf("TZ=UTC0 touch -m -t %s %s", stamp, shellQuote(p))
+}
+
+func (posixShell) chmod(p, perms string) string {
+	return fmt.Sprintf("chmod %s %s", perms, shellQuote(p))
+}
+
+func (posixShell) writeTest(dir string) string {
+	tmpl := path.Join(dir, ".pssh-write-test.XXXXXX")
+	return fmt.Sprintf("mkdir -p %s && f=$(mktemp %s) && rm -f \"$f\"", shellQuote(dir), shellQuote(tmpl))
+}
+
+func (posixShell) now() string {
+	return "date +%s"
+}
+
+func (posixShell) home() string {
+	return "cd && pwd"
+}
+
+func (posixShell) checksums(dir string) string {
+	return fmt.Sprintf("[ ! -d %s ] || find %s -type f -exec sha256sum {} +", shellQuote(dir), shellQuote(dir))
+}
+
+// fileChecksums ignores the errors for paths which do not exist, but not a
+// missing `sha256sum`.
+func (posixShell) fileChecksums(paths []string) []string {
+	quoted := make([]string, len(paths))
+	for i, p := range paths {
+		quoted[i] = shellQuote(p)
+	}
+	return batchCommands(quoted, " ", posixMaxArgs, func(args string) string {
+		return "command -v sha256sum >/dev/null || exit 127; sha256sum -- " + args + " 2>/dev/null; exit 0"
+	})
+}
+
+func (posixShell) scpSink(scp, dir string) string {
+	return shellQuote(scp) + " -qt " + shellQuote(dir)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// windowsShell builds commands for windows OpenSSH.  The default shell there
+// may be cmd or PowerShell, so each command is a PowerShell script run through
+// `powershell`, which works from either.
+type windowsShell struct{}
+
+// psQuote quotes `s` as a literal PowerShell string.
+func psQuote(s string) string {
+	return "'" + strings.Replace(s, "'", "''", -1) + "'"
+}
+
+// powershell returns the command to run `script`.  The script is wrapped in
+// double quotes for cmd, which windows paths can not contain.  Errors are made
+// terminating so that a failure gives a non-zero exit.
+func (windowsShell) powershell(script string) string {
+	return fmt.Sprintf(`powershell -NoProfile -NonInteractive -Command "$ErrorActionPreference = 'Stop'; %s"`, script)
+}
+
+func (w windowsShell) mkdirAll(dir string) string {
+	return w.powershell(fmt.Sprintf("New-Item -ItemType Directory -Force -Path %s | Out-Null", psQuote(dir)))
+}
+
+func (w windowsShell) remove(p string) string {
+	return w.powershell(fmt.Sprintf("if (Test-Path -LiteralPath %s) { Remove-Item -Force -LiteralPath %s }", psQuote(p), psQuote(p)))
+}
+
+func (w windowsShell) rename(from, to string) string {
+	return w.powershell(fmt.Sprintf("Move-Item -Force -LiteralPath %s -Destination %s", psQuote(from), psQuote(to)))
+}
+
+func (w windowsShell) touch(p string, mtime time.Time) string {
+	return w.powershell(fmt.Sprintf("(Get-Item -LiteralPath %s).LastWriteTimeUtc = [DateTimeOffset]::FromUnixTimeSeconds(%d).UtcDateTime",
+		psQuote(p), mtime.Unix()))
+}
+
+// chmod can only map the owner write bit, to the read-only attribute, as
+// windows has no other permissions to set.
+func (w windowsShell) chmod(p, perms string) string {
+	readOnly := "$false"
+	if mode, err := strconv.ParseUint(perms, 8, 32); err == nil && mode&0200 == 0 {
+		readOnly = "$true"
+	}
+	return w.powershell(fmt.Sprintf("(Get-Item -LiteralPath %s).IsReadOnly = %s", psQuote(p), readOnly))
+}
+
+func (w windowsShell) writeTest(dir string) string {
+	return w.powershell(fmt.Sprintf("New-Item -ItemType Directory -Force -Path %s | Out-Null; "+
+		"$f = Join-Path %s ('.pssh-write-test.' + [guid]::NewGuid()); "+
+		"New-Item -ItemType File -Path $f | Out-Null; Remove-Item -Force -LiteralPath $f",
+		psQuote(dir), psQuote(dir)))
+}
+
+func (w windowsShell) now() string {
+	return w.powershell("[DateTimeOffset]::UtcNow.ToUnixTimeSeconds()")
+}
+
+func (w windowsShell) home() string {
+	return w.powershell("$HOME")
+}
+
+func (w windowsShell) checksums(dir string) string {
+	// `Get-ChildItem` skips hidden files without `-Force`.
+	return w.powershell(fmt.Sprintf("if (Test-Path -LiteralPath %s) { "+
+		"$d = (Get-Item -LiteralPath %s).FullName.TrimEnd('\\'); "+
+		"Get-ChildItem -Force -Recurse -File -LiteralPath $d | ForEach-Object { "+
+		"(Get-FileHash -Algorithm SHA256 -LiteralPath $_.FullName).Hash.ToLower() + '  ' + "+
+		"%s + $_.FullName.Substring($d.Length + 1).Replace('\\', '/') } }",
+		psQuote(dir), psQuote(dir), psQuote(strings.TrimSuffix(dir, "/")+"/")))
+}
+
+func (w windowsShell) fileChecksums(paths []string) []string {
+	quoted := make([]string, len(paths))
+	for i, p := range paths {
+		quoted[i] = psQuote(p)
+	}
+	return batchCommands(quoted, ",", windowsMaxArgs, func(args string) string {
+		return w.powershell(fmt.Sprintf("foreach ($p in @(%s)) { if (Test-Path -LiteralPath $p -PathType Leaf) { "+
+			"(Get-FileHash -Algorithm SHA256 -LiteralPath $p).Hash.ToLower() + '  ' + $p } }", args))
+	})
+}
+
+func (w windowsShell) scpSink(scp, dir string) string {
+	return w.powershell(fmt.Sprintf("& %s -qt %s", psQuote(scp), psQuote(dir)))
+}
+
+// checkRemoteOS returns an error if `opts` asks for an unknown remote
+// operating system, or for options which it can not support.
+func checkRemoteOS(opts Options) error {
+	if _, err := newRemoteShell(opts.RemoteOS); err != nil {
+		return err
+	}
+	if opts.RemoteOS != RemoteOSWindows {
+		return nil
+	}
+
+	// These run POSIX utilities on the remote which have no builder.
+	for _, o := range []struct {
+		name string
+		set  bool
+	}{
+		{"delta", opts.Delta},
+		{"compress", opts.Compress},
+		{"dedup", opts.Dedup},
+		{"marker", opts.Marker},
+		{"symlinks copy", opts.Symlinks == SymlinksCopy},
+	} {
+		if o.set {
+			return fmt.Errorf("%s is not supported with remote os %s", o.name, opts.RemoteOS)
+		}
+	}
+	return nil
+}
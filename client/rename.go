@@ -0,0 +1,290 @@
+package client
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/rjeczalik/notify"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+
+// renameWindow is how long the events which may be either side of a rename
+// are held so that the two sides can be paired up.
+const renameWindow = 100 * time.Millisecond
+
+// renamePairer pairs up the two sides of a rename so that it can be done with
+// a remote `mv` rather than a remove and a fresh upload.  Watchers report each
+// side of a rename as a separate event which only carries one path, and which
+// events those are depends on the platform:
+//
+//   - linux (inotify): a `notify.Rename` for the old name and a
+//     `notify.Create` for the new name.  A renamed directory also gets a
+//     second `notify.Rename` for itself.
+//   - macOS (FSEvents): a `notify.Rename` for each name, possibly batched
+//     with other events.
+//   - windows (ReadDirectoryChangesW): a `notify.Rename` for each name.
+//
+// The watcher does not keep the two sides in order, or even next to each
+// other, so the old names (renames of paths which no longer exist) and the
+// candidate new names (creates and renames of paths which do) are collected
+// for `renameWindow` and then matched up as a batch, see `pairRenames`.
+type renamePairer struct {
+	olds  []string       // paths which were renamed away
+	news  []pendingEvent // paths which appeared
+	timer *time.Timer
+}
+
+// hold records the event `e` for `path` if it may be one side of a rename,
+// and returns false if it can not be.
+func (r *renamePairer) hold(path string, e notify.Event) bool {
+	if e != notify.Rename && e != notify.Create {
+		return false
+	}
+
+	if _, err := os.Lstat(path); os.IsNotExist(err) {
+		if e != notify.Rename {
+			return false
+		}
+		for _, p := range r.olds {
+			if p == path {
+				return true
+			}
+		}
+		r.olds = append(r.olds, path)
+	} else {
+		for _, pe := range r.news {
+			if pe.path == path {
+				return true
+			}
+		}
+		r.news = append(r.news, pendingEvent{path: path, event: e})
+	}
+
+	if r.timer == nil {
+		r.timer = time.NewTimer(renameWindow)
+	}
+	return true
+}
+
+// take removes and returns everything held.
+func (r *renamePairer) take() ([]string, []pendingEvent) {
+	olds, news := r.olds, r.news
+	r.olds, r.news = nil, nil
+	r.stop()
+	return olds, news
+}
+
+// C returns a channel which fires when the held events are due, or nil if
+// nothing is held.
+func (r *renamePairer) C() <-chan time.Time {
+	if r.timer == nil {
+		return nil
+	}
+	return r.timer.C
+}
+
+// stop releases the timer, held events are dropped.
+func (r *renamePairer) stop() {
+	if r.timer != nil {
+		r.timer.Stop()
+		r.timer = nil
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// pairRenames moves the remote copies of the `olds` which match one of the
+// `news`, and returns the events which were not part of a rename.  A new file
+// matches an old one whose remote copy has the same checksum, and a new
+// directory matches an old one whose remote copy holds files of the same
+// names, so a remote copy is only ever moved where it would have been sent
+// anyway.  Without checksums, with `Force`, nothing is paired.
+func (c *Client) pairRenames(olds []string, news []pendingEvent) ([]string, []pendingEvent) {
+	unpaired := []pendingEvent{}
+	for _, pe := range news {
+		matched := -1
+		for i, old := range olds {
+			if c.sameAsRemote(pe.path, old) {
+				matched = i
+				break
+			}
+		}
+		if matched < 0 {
+			unpaired = append(unpaired, pe)
+			continue
+		}
+
+		c.handleMove(olds[matched], pe.path)
+		olds = append(olds[:matched], olds[matched+1:]...)
+	}
+	return olds, unpaired
+}
+
+// sameAsRemote returns true if the local path `p` has the contents last synced
+// to the remote copy of the local path `old`.
+func (c *Client) sameAsRemote(p, old string) bool {
+	remote, err := c.remotePathFor(old)
+	if err != nil {
+		return false
+	}
+
+	fi, err := os.Stat(p)
+	if err != nil {
+		return false
+	}
+	if fi.Mode().IsRegular() {
+		f, err := os.Open(p)
+		if err != nil {
+			return false
+		}
+		defer f.Close()
+		sum, err := c.sums.sum(f, p)
+		if err != nil {
+			return false
+		}
+
+		c.sumsLock.Lock()
+		defer c.sumsLock.Unlock()
+		return c.remoteSums[remote] == sum
+	}
+	if !fi.IsDir() {
+		return false
+	}
+
+	// Compare the names of the files in the directory with those synced
+	// under the old one.
+	local := map[string]bool{}
+	c.walkLocal(p, func(lp string, lfi os.FileInfo, err error) error {
+		if err == nil && lfi.IsDir() && c.hidden(lp) {
+			return filepath.SkipDir
+		}
+		if err == nil && !lfi.IsDir() && !c.ignored(lp) {
+			if rel, err := filepath.Rel(p, lp); err == nil {
+				local[filepath.ToSlash(rel)] = true
+			}
+		}
+		return nil
+	})
+
+	c.sumsLock.Lock()
+	defer c.sumsLock.Unlock()
+	n := 0
+	for rp := range c.remoteSums {
+		if strings.HasPrefix(rp, remote+"/") {
+			if !local[strings.TrimPrefix(rp, remote+"/")] {
+				return false
+			}
+			n++
+		}
+	}
+	return n > 0 && n == len(local)
+}
+
+// dispatchRenames queues the pairing of `olds` and `news` on `disp`, see
+// `pairRenames`, behind any earlier changes to either side, which must be on
+// the remote before it is compared with and moved.  Changes which arrive
+// meanwhile wait for it in turn.  The events which were not part of a rename
+// are handled by the same job, in the order they would have been otherwise.
+func (c *Client) dispatchRenames(disp *dispatcher, olds []string, news []pendingEvent) {
+	paths := append([]string{}, olds...)
+	for _, pe := range news {
+		paths = append(paths, pe.path)
+	}
+	disp.addChange(paths, func() {
+		olds, news := c.pairRenames(olds, news)
+		for _, p := range olds {
+			c.handleEvent(p, notify.Rename)
+		}
+		for _, pe := range news {
+			c.handleEvent(pe.path, pe.event)
+		}
+	})
+}
+
+// handleMove is fired when the local path `from` was renamed to `to`.  The
+// remote copy is moved to match, and then `to` is synced, which is cheap as
+// the contents came across with the move.  If the move fails, `from` is
+// removed and `to` is synced from scratch.
+func (c *Client) handleMove(from, to string) {
+	start := time.Now()
+	c.textStatus(fmt.Sprintf("rename :: %s --> %s", from, to))
+
+	remoteFrom, err := c.remotePathFor(from)
+	if err != nil {
+		c.syncError(from, err)
+		return
+	}
+	remoteTo, err := c.remotePathFor(to)
+	if err != nil {
+		c.syncError(to, err)
+		return
+	}
+
+	if err := c.remoteMove(remoteFrom, remoteTo); err == nil {
+		c.moveRemoteSums(remoteFrom, remoteTo)
+	} else if err := c.remoteRemoveFile(from); err != nil {
+		c.syncError(from, err)
+	}
+
+	if fi, serr := os.Stat(to); serr == nil && fi.IsDir() {
+		err = c.remoteCreateDir(to)
+	} else {
+		err = c.remoteUpdateFile(to)
+	}
+	if err != nil {
+		c.syncError(to, err)
+	}
+	c.logResult("rename", to, remoteTo, 0, start, err)
+}
+
+// remoteMove renames the remote path `from` to `to`, replacing `to` if it
+// exists.
+func (c *Client) remoteMove(from, to string) error {
+	if c.opts.DryRun {
+		c.status(fmt.Sprintf("[dry-run] move %s --> %s", from, to))
+		return nil
+	}
+	if err := c.ensureRemoteDirectory(to); err != nil {
+		return err
+	}
+	return c.renameRemote(from, to)
+}
+
+// moveRemoteSums carries the recorded checksums, times and modes of the remote
+// path `from`, and anything under it, over to `to` after it was moved.
+func (c *Client) moveRemoteSums(from, to string) {
+	c.sumsLock.Lock()
+	defer c.sumsLock.Unlock()
+
+	moved := func(p string) (string, bool) {
+		if p == from {
+			return to, true
+		}
+		if strings.HasPrefix(p, from+"/") {
+			return to + strings.TrimPrefix(p, from), true
+		}
+		return "", false
+	}
+	for p, sum := range c.remoteSums {
+		if np, ok := moved(p); ok {
+			delete(c.remoteSums, p)
+			c.remoteSums[np] = sum
+		}
+	}
+	for p, t := range c.remoteTimes {
+		if np, ok := moved(p); ok {
+			delete(c.remoteTimes, p)
+			c.remoteTimes[np] = t
+		}
+	}
+	for p, m := range c.remoteModes {
+		if np, ok := moved(p); ok {
+			delete(c.remoteModes, p)
+			c.remoteModes[np] = m
+		}
+	}
+}
@@ -0,0 +1,39 @@
+//go:build !windows
+// +build !windows
+
+package client
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// watchWindowSize forwards changes to the size of the terminal `fd` to the
+// pty of `sess` until the returned function is called.
+func watchWindowSize(fd int, sess *ssh.Session) func() {
+	sigs := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	signal.Notify(sigs, syscall.SIGWINCH)
+
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-sigs:
+				if w, h, err := terminal.GetSize(fd); err == nil {
+					sess.WindowChange(h, w)
+				}
+			}
+		}
+	}()
+
+	return func() {
+		signal.Stop(sigs)
+		close(done)
+	}
+}
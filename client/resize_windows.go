@@ -0,0 +1,44 @@
+//go:build windows
+// +build windows
+
+package client
+
+import (
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// resizePollInterval is how often the size of the console is checked, as
+// windows has no SIGWINCH.
+const resizePollInterval = 500 * time.Millisecond
+
+// watchWindowSize forwards changes to the size of the console `fd` to the pty
+// of `sess` until the returned function is called.
+func watchWindowSize(fd int, sess *ssh.Session) func() {
+	done := make(chan struct{})
+	ticker := time.NewTicker(resizePollInterval)
+
+	go func() {
+		lastW, lastH, _ := terminal.GetSize(fd)
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				w, h, err := terminal.GetSize(fd)
+				if err != nil || (w == lastW && h == lastH) {
+					continue
+				}
+				lastW, lastH = w, h
+				sess.WindowChange(h, w)
+			}
+		}
+	}()
+
+	return func() {
+		ticker.Stop()
+		close(done)
+	}
+}
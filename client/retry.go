@@ -0,0 +1,44 @@
+package client
+
+import (
+	"fmt"
+	"time"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+
+const (
+	// DefaultTransferRetries is the default number of times a file transfer
+	// is retried after it fails.
+	DefaultTransferRetries = 3
+
+	// DefaultTransferRetryDelay is the default wait before the first retry
+	// of a file transfer, which doubles after each further failure.
+	DefaultTransferRetryDelay = 500 * time.Millisecond
+)
+
+// withTransferRetries runs `fn`, the transfer of `local`, retrying it up to
+// `TransferRetries` times with exponential backoff if it fails.  Once the
+// retries are used up, or the client is closed, the last error is returned.
+func (c *Client) withTransferRetries(local string, fn func() error) error {
+	err := fn()
+	delay := c.opts.TransferRetryDelay
+	for attempt := 1; err != nil && c.ctx.Err() == nil && attempt <= c.opts.TransferRetries; attempt++ {
+		c.textStatus(fmt.Sprintf("Sync of %s failed (%s), retrying in %s (attempt %d of %d)",
+			local, err.Error(), delay, attempt, c.opts.TransferRetries))
+
+		select {
+		case <-c.ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+
+		err = fn()
+		delay *= 2
+	}
+
+	if err != nil && c.ctx.Err() == nil && c.opts.TransferRetries > 0 {
+		err = fmt.Errorf("%s, gave up after %d attempts", err.Error(), c.opts.TransferRetries+1)
+	}
+	return err
+}
@@ -0,0 +1,211 @@
+package client
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/kevinburke/ssh_config"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+
+// sshHostConfig holds the settings from ~/.ssh/config which apply to a host.
+// Only the settings pssh uses are read, and `Match` blocks are ignored.
+type sshHostConfig struct {
+	HostName      string
+	User          string
+	Port          int
+	IdentityFiles []string
+}
+
+// sshConfigPath returns the path to the current user's ssh config.
+func sshConfigPath() (string, error) {
+	u, err := user.Current()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(u.HomeDir, ".ssh", "config"), nil
+}
+
+// expandHome replaces a leading `~/` in `p` with the current user's home.
+func expandHome(p string) string {
+	if !strings.HasPrefix(p, "~/") {
+		return p
+	}
+	u, err := user.Current()
+	if err != nil {
+		return p
+	}
+	return filepath.Join(u.HomeDir, p[2:])
+}
+
+// loadSSHConfig returns the settings in the ssh config at `p` which apply to
+// `host`.  As with ssh, the first value found for each setting wins, except
+// for `IdentityFile` which accumulates.  A missing file is not an error.
+func loadSSHConfig(p, host string) (*sshHostConfig, error) {
+	ret := &sshHostConfig{}
+
+	bs, err := ioutil.ReadFile(p)
+	if os.IsNotExist(err) {
+		return ret, nil
+	} else if err != nil {
+		return nil, err
+	}
+	cfg, err := ssh_config.Decode(bytes.NewReader(withoutMatchBlocks(bs)))
+	if err != nil {
+		return nil, err
+	}
+
+	set := func(key, value string) {
+		switch strings.ToLower(key) {
+		case "hostname":
+			if len(ret.HostName) == 0 {
+				ret.HostName = strings.Replace(value, "%h", host, -1)
+			}
+		case "user":
+			if len(ret.User) == 0 {
+				ret.User = value
+			}
+		case "port":
+			if ret.Port == 0 {
+				if port, err := strconv.Atoi(value); err == nil {
+					ret.Port = port
+				}
+			}
+		case "identityfile":
+			ret.IdentityFiles = append(ret.IdentityFiles, expandHome(value))
+		}
+	}
+
+	for _, h := range cfg.Hosts {
+		if !h.Matches(host) {
+			continue
+		}
+		for _, node := range h.Nodes {
+			switch n := node.(type) {
+			case *ssh_config.KV:
+				set(n.Key, n.Value)
+			case *ssh_config.Include:
+				for _, key := range []string{"HostName", "User", "Port", "IdentityFile"} {
+					set(key, n.Get(host, key))
+				}
+			}
+		}
+	}
+	return ret, nil
+}
+
+// withoutMatchBlocks blanks out the `Match` blocks of the config `bs`, which
+// the ssh_config package refuses to parse.  Each block runs until the next
+// `Host` line.  Lines are blanked rather than dropped so that parse errors
+// still point at the right line.
+func withoutMatchBlocks(bs []byte) []byte {
+	var out bytes.Buffer
+	skip := false
+	for _, line := range strings.SplitAfter(string(bs), "\n") {
+		words := strings.FieldsFunc(line, func(r rune) bool {
+			return unicode.IsSpace(r) || r == '='
+		})
+		if len(words) > 0 {
+			switch strings.ToLower(words[0]) {
+			case "match":
+				skip = true
+			case "host":
+				skip = false
+			}
+		}
+		if skip {
+			line = strings.TrimLeftFunc(line, func(r rune) bool { return r != '\n' })
+		}
+		out.WriteString(line)
+	}
+	return out.Bytes()
+}
+
+// identityFile returns the first of the configured identity files which
+// exists, or "" if there are none.
+func (h *sshHostConfig) identityFile() string {
+	for _, p := range h.IdentityFiles {
+		if _, err := os.Stat(p); err == nil {
+			return p
+		}
+	}
+	return ""
+}
+
+// bracketedHostPlaceholder stands in for an IPv6 literal while an address is
+// split on colons, see `unbracketHost`.
+const bracketedHostPlaceholder = "ipv6-literal"
+
+// unbracketHost finds a host written in brackets in `addr`, as IPv6 literals
+// must be (ex: `user@[::1]:22:/tmp`) since colons otherwise separate the port
+// and remote directory.  It returns the host without the brackets, and `addr`
+// with the host replaced by `bracketedHostPlaceholder`.  If the host is not
+// bracketed it returns "" and `addr` as it is.
+func unbracketHost(addr string) (string, string) {
+	start := strings.LastIndex(addr, "@") + 1
+	if !strings.HasPrefix(addr[start:], "[") {
+		return "", addr
+	}
+	end := strings.Index(addr[start:], "]")
+	if end < 0 {
+		return "", addr
+	}
+	return addr[start+1 : start+end], addr[:start] + bracketedHostPlaceholder + addr[start+end+1:]
+}
+
+// addrHasPort returns true if the `user@host:port` address given to `New`
+// spells out a port, rather than leaving sshaddr to default it.
+func addrHasPort(addr string) bool {
+	_, addr = unbracketHost(addr)
+	if i := strings.LastIndex(addr, "@"); i >= 0 {
+		addr = addr[i+1:]
+	}
+	parts := strings.Split(addr, ":")
+	if len(parts) < 2 {
+		return false
+	}
+	_, err := strconv.Atoi(parts[1])
+	return err == nil
+}
+
+// hostConfigFor returns the ssh config settings for the host in `addr`, and
+// `addr` with the configured (or local) user filled in if it has none.
+func hostConfigFor(addr string) (*sshHostConfig, string, error) {
+	host, rest := unbracketHost(addr)
+	if len(host) == 0 {
+		host = rest
+		if i := strings.LastIndex(host, "@"); i >= 0 {
+			host = host[i+1:]
+		}
+		if i := strings.Index(host, ":"); i >= 0 {
+			host = host[:i]
+		}
+	}
+
+	cfg := &sshHostConfig{}
+	if p, err := sshConfigPath(); err == nil {
+		if cfg, err = loadSSHConfig(p, host); err != nil {
+			return nil, "", err
+		}
+	}
+
+	if !strings.Contains(addr, "@") {
+		name := cfg.User
+		if len(name) == 0 {
+			u, err := user.Current()
+			if err != nil {
+				return nil, "", err
+			}
+			name = u.Username
+		}
+		addr = name + "@" + addr
+	}
+	return cfg, addr, nil
+}
@@ -0,0 +1,87 @@
+package client
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestUnbracketHost(t *testing.T) {
+	for _, tc := range []struct {
+		addr, host, rest string
+	}{
+		{"user@[::1]:22:/tmp", "::1", "user@" + bracketedHostPlaceholder + ":22:/tmp"},
+		{"user@[fe80::1%eth0]:/tmp", "fe80::1%eth0", "user@" + bracketedHostPlaceholder + ":/tmp"},
+		{"[2001:db8::1]:2222:/srv/app", "2001:db8::1", bracketedHostPlaceholder + ":2222:/srv/app"},
+		{"user:p@ss@[::1]:/tmp", "::1", "user:p@ss@" + bracketedHostPlaceholder + ":/tmp"},
+		{"user@host:22:/tmp", "", "user@host:22:/tmp"},
+		{"user@[::1:22:/tmp", "", "user@[::1:22:/tmp"},
+		{"user@host:/tmp/[x]", "", "user@host:/tmp/[x]"},
+	} {
+		host, rest := unbracketHost(tc.addr)
+		if host != tc.host || rest != tc.rest {
+			t.Errorf("unbracketHost(%q) = %q, %q, want %q, %q", tc.addr, host, rest, tc.host, tc.rest)
+		}
+	}
+}
+
+func TestAddrHasPort(t *testing.T) {
+	for _, tc := range []struct {
+		addr string
+		port bool
+	}{
+		{"user@[::1]:2222:/tmp", true},
+		{"user@[::1]:/tmp", false},
+		{"user@[2001:db8::22]:/tmp", false},
+		{"user@[::1]", false},
+		{"user@host:2222:/tmp", true},
+		{"user@host:/tmp", false},
+		{"host", false},
+	} {
+		if got := addrHasPort(tc.addr); got != tc.port {
+			t.Errorf("addrHasPort(%q) = %v, want %v", tc.addr, got, tc.port)
+		}
+	}
+}
+
+func TestResolveAddrIPv6(t *testing.T) {
+	log := newVerboseLogger(Options{VerboseOutput: ioutil.Discard})
+	for _, tc := range []struct {
+		addr string
+		host string
+		port int
+		dir  string
+	}{
+		{"user@[::1]:2222:/tmp/a", "::1", 2222, "/tmp/a"},
+		{"user@[2001:db8::1]:/srv/app", "2001:db8::1", 22, "/srv/app"},
+		{"user@[fe80::1%eth0]:22:/srv/app", "fe80::1%eth0", 22, "/srv/app"},
+	} {
+		ra, _, err := resolveAddr(tc.addr, Options{}, log)
+		if err != nil {
+			t.Errorf("resolveAddr(%q) failed: %s", tc.addr, err)
+			continue
+		}
+		if ra.user != "user" || ra.host != tc.host || ra.port != tc.port || ra.remoteDir != tc.dir {
+			t.Errorf("resolveAddr(%q) = %s@%s port %d dir %s, want user@%s port %d dir %s",
+				tc.addr, ra.user, ra.host, ra.port, ra.remoteDir, tc.host, tc.port, tc.dir)
+		}
+		if want := "[" + tc.host + "]:"; !strings.HasPrefix(ra.hostPort(), want) {
+			t.Errorf("hostPort() = %q, want the host in brackets", ra.hostPort())
+		}
+	}
+}
+
+func TestLoadSSHConfigIPv6HostName(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "config")
+	if err := ioutil.WriteFile(p, []byte("Host v6box\n  HostName 2001:db8::1\n  Port 2222\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := loadSSHConfig(p, "v6box")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.HostName != "2001:db8::1" || cfg.Port != 2222 {
+		t.Errorf("loadSSHConfig = HostName %q Port %d, want 2001:db8::1 and 2222", cfg.HostName, cfg.Port)
+	}
+}
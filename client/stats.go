@@ -0,0 +1,83 @@
+package client
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+
+// Stats counts the changes a client has synced since it was created, see
+// `Client.Stats`.
+type Stats struct {
+	Synced     int           `json:"synced"`  // files whose contents were sent
+	Created    int           `json:"created"` // create events synced
+	Updated    int           `json:"updated"` // write events synced
+	Removed    int           `json:"removed"` // remove events synced
+	Renamed    int           `json:"renamed"` // rename events synced
+	Bytes      int64         `json:"bytes"`   // bytes of the files sent
+	Errors     int           `json:"errors"`  // changes which failed to sync
+	Elapsed    time.Duration `json:"-"`
+	DurationMs int64         `json:"duration_ms"`
+}
+
+// String summarizes the stats on one line.
+func (s Stats) String() string {
+	return fmt.Sprintf("Synced %d files (%d bytes) in %s: %d created, %d updated, %d removed, %d renamed, %d errors",
+		s.Synced, s.Bytes, s.Elapsed.Round(time.Millisecond), s.Created, s.Updated, s.Removed, s.Renamed, s.Errors)
+}
+
+// statsCounter accumulates `Stats` from the results of each event.
+type statsCounter struct {
+	lock    sync.Mutex
+	stats   Stats
+	started time.Time
+}
+
+// add counts the outcome of `event`, as named in the `LogJSON` output, which
+// sent `bytes` if it was a sync.  Failures are counted by `syncError` instead.
+func (s *statsCounter) add(event string, bytes int64, err error) {
+	if err != nil {
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	switch event {
+	case "sync":
+		s.stats.Synced++
+		s.stats.Bytes += bytes
+	case "create":
+		s.stats.Created++
+	case "write":
+		s.stats.Updated++
+	case "remove":
+		s.stats.Removed++
+	case "rename":
+		s.stats.Renamed++
+	}
+}
+
+// Stats returns the changes synced since the client was created.
+func (c *Client) Stats() Stats {
+	c.stats.lock.Lock()
+	s := c.stats.stats
+	c.stats.lock.Unlock()
+
+	s.Errors = c.Failures()
+	s.Elapsed = time.Since(c.stats.started)
+	s.DurationMs = int64(s.Elapsed / time.Millisecond)
+	return s
+}
+
+// reportStats prints the summary of `Stats`, or logs it as a "summary" entry
+// with `LogJSON`.
+func (c *Client) reportStats() {
+	s := c.Stats()
+	if c.opts.LogJSON {
+		c.logJSON(logEntry{Event: "summary", DurationMs: s.DurationMs, Summary: &s})
+		return
+	}
+	c.status(s.String())
+}
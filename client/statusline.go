@@ -0,0 +1,107 @@
+package client
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+
+// clearLine returns the cursor to the start of the line and clears it.
+const clearLine = "\r\033[K"
+
+// statusLine is the line of the terminal used for status messages.  When
+// stdout is a terminal, transient messages such as the file being synced are
+// drawn over each other in place.  They are cleared before anything else is
+// printed, including output from the remote shell, so that they never clobber
+// it.  Otherwise every message is printed on a line of its own.
+type statusLine struct {
+	out io.Writer
+	fd  int
+	tty bool
+
+	lock    sync.Mutex
+	pending bool // a transient message is on the current line
+}
+
+// stdoutStatus is the status line of stdout, which is shared by every client.
+var stdoutStatus = newStatusLine(os.Stdout)
+
+// newStatusLine returns the status line for `f`.
+func newStatusLine(f *os.File) *statusLine {
+	fd := int(f.Fd())
+	return &statusLine{out: f, fd: fd, tty: terminal.IsTerminal(fd)}
+}
+
+// transient draws `msg` in place of the current transient message.
+func (s *statusLine) transient(msg string) {
+	if !s.tty {
+		s.println(msg)
+		return
+	}
+
+	// A message which wraps can not be drawn over, so keep it to the width
+	// of the terminal.
+	if w, _, err := terminal.GetSize(s.fd); err == nil && w > 1 && len(msg) >= w {
+		if rs := []rune(msg); len(rs) >= w {
+			msg = string(rs[:w-1])
+		}
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	fmt.Fprint(s.out, clearLine+msg)
+	s.pending = true
+}
+
+// println prints `msg` on a line of its own, replacing any transient message.
+func (s *statusLine) println(msg string) {
+	s.fprintln(s.out, msg)
+}
+
+// fprintln is `println` for `w`, which shares the terminal with the status
+// line (ex: stderr).
+func (s *statusLine) fprintln(w io.Writer, msg string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.clear()
+	fmt.Fprintf(w, "\r%s\n", msg)
+}
+
+// clear removes the transient message, if there is one.  The lock must be
+// held.
+func (s *statusLine) clear() {
+	if s.pending {
+		fmt.Fprint(s.out, clearLine)
+		s.pending = false
+	}
+}
+
+// finish removes the transient message, if there is one.
+func (s *statusLine) finish() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.clear()
+}
+
+// writer returns a writer for `w`, which shares the terminal with the status
+// line, which clears the transient message before each write.
+func (s *statusLine) writer(w io.Writer) io.Writer {
+	return statusLineWriter{s: s, w: w}
+}
+
+type statusLineWriter struct {
+	s *statusLine
+	w io.Writer
+}
+
+func (sw statusLineWriter) Write(p []byte) (int, error) {
+	sw.s.lock.Lock()
+	defer sw.s.lock.Unlock()
+	sw.s.clear()
+	return sw.w.Write(p)
+}
@@ -0,0 +1,127 @@
+package client
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+
+// Policies for local symlinks, see `Options.Symlinks`.
+const (
+	SymlinksFollow = "follow" // sync what the link points to
+	SymlinksCopy   = "copy"   // recreate the link on the remote
+	SymlinksSkip   = "skip"   // ignore links entirely
+)
+
+// isSymlink returns true if `fi` describes a symbolic link.
+func isSymlink(fi os.FileInfo) bool {
+	return fi.Mode()&os.ModeSymlink != 0
+}
+
+// walkLocal walks the local tree rooted at `root` like `filepath.Walk`, but
+// applies the `Symlinks` policy to any links it finds.  With `SymlinksCopy`
+// links are passed to `fn` as they are, and with `SymlinksFollow` they are
+// passed as whatever they point to.  The directories being walked are tracked
+// by their resolved path so that a link back up the tree is not followed
+// forever.
+func (c *Client) walkLocal(root string, fn filepath.WalkFunc) error {
+	parents := map[string]bool{}
+
+	var walk func(p string, fi os.FileInfo) error
+	walk = func(p string, fi os.FileInfo) error {
+		if isSymlink(fi) {
+			switch c.opts.Symlinks {
+			case SymlinksSkip:
+				return nil
+			case SymlinksFollow:
+				target, err := os.Stat(p)
+				if err != nil {
+					return nil // dangling
+				}
+				fi = target
+			}
+		}
+
+		err := fn(p, fi, nil)
+		if !fi.IsDir() || err != nil {
+			if err == filepath.SkipDir {
+				return nil
+			}
+			return err
+		}
+
+		real, err := filepath.EvalSymlinks(p)
+		if err != nil {
+			return fn(p, fi, err)
+		}
+		if parents[real] {
+			c.status(fmt.Sprintf("Skipping %s: symlink loop", p))
+			return nil
+		}
+		parents[real] = true
+		defer delete(parents, real)
+
+		d, err := os.Open(p)
+		if err != nil {
+			return fn(p, fi, err)
+		}
+		names, err := d.Readdirnames(-1)
+		d.Close()
+		if err != nil {
+			return fn(p, fi, err)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			child := filepath.Join(p, name)
+			cfi, err := os.Lstat(child)
+			if err != nil {
+				if err := fn(child, nil, err); err != nil && err != filepath.SkipDir {
+					return err
+				}
+				continue
+			}
+			if err := walk(child, cfi); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	fi, err := os.Lstat(root)
+	if err != nil {
+		return fn(root, nil, err)
+	}
+	return walk(root, fi)
+}
+
+// remoteSymlink recreates the local symlink `local` at `remote`.  The link
+// target is copied as is, so relative links which stay inside the synced tree
+// keep working on the remote.
+func (c *Client) remoteSymlink(local, remote string) error {
+	target, err := os.Readlink(local)
+	if err != nil {
+		return err
+	}
+
+	if c.opts.DryRun {
+		c.status(fmt.Sprintf("[dry-run] link %s --> %s", remote, target))
+		return nil
+	}
+
+	c.status(fmt.Sprintf("Link file: %s --> %s", remote, target))
+	if err := c.ensureRemoteDirectory(remote); err != nil {
+		return err
+	}
+
+	if sc := c.sftpSession(); sc != nil {
+		if err := sc.Remove(remote); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return sc.Symlink(target, remote)
+	}
+	return c.runRemoteCommand(fmt.Sprintf("ln -sfn %s %s", shellQuote(target), shellQuote(remote)))
+}
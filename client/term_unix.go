@@ -0,0 +1,11 @@
+//go:build !windows
+// +build !windows
+
+package client
+
+import "syscall"
+
+// stdinFd and stdoutFd return the descriptors of the local terminal as used by
+// the terminal package.
+func stdinFd() int  { return int(syscall.Stdin) }
+func stdoutFd() int { return int(syscall.Stdout) }
@@ -0,0 +1,12 @@
+//go:build windows
+// +build windows
+
+package client
+
+import "os"
+
+// stdinFd and stdoutFd return the console handles of the local terminal as
+// used by the terminal package.  On windows the input and output handles are
+// distinct, so the size of the terminal must be read from stdout.
+func stdinFd() int  { return int(os.Stdin.Fd()) }
+func stdoutFd() int { return int(os.Stdout.Fd()) }
@@ -0,0 +1,60 @@
+package client
+
+import (
+	"fmt"
+	"strings"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+
+// ConnInfo is where an address resolves to, after ~/.ssh/config and the
+// options are applied, see `Resolve`.
+type ConnInfo struct {
+	User      string
+	Host      string
+	Port      int
+	RemoteDir string
+
+	Container string // set instead of the above for container addresses
+}
+
+func (i ConnInfo) String() string {
+	remote := i.RemoteDir
+	if len(remote) == 0 {
+		remote = "~"
+	}
+	if len(i.Container) > 0 {
+		return fmt.Sprintf("container=%s remote=%s", i.Container, remote)
+	}
+	return fmt.Sprintf("user=%s host=%s port=%d remote=%s", i.User, i.Host, i.Port, remote)
+}
+
+// Resolve returns where `New` would connect to for `addr`, without connecting.
+// The remote directory is empty if it is the remote user's home, which is only
+// known once connected, see `Client.RemoteDir`.
+func Resolve(addr string, opts Options) (ConnInfo, error) {
+	if _, remoteDir, ok := parseContainerAddr(addr); ok {
+		name := strings.TrimSuffix(addr, ":"+remoteDir)
+		if len(opts.RemoteDir) > 0 {
+			remoteDir = opts.RemoteDir
+		}
+		return ConnInfo{Container: name, RemoteDir: remoteDir}, nil
+	}
+
+	ra, _, err := resolveAddr(addr, opts, newVerboseLogger(opts))
+	if err != nil {
+		return ConnInfo{}, err
+	}
+	return ConnInfo{User: ra.user, Host: ra.host, Port: ra.port, RemoteDir: ra.remoteDir}, nil
+}
+
+// RemoteDir returns the remote directory files are synced to.
+func (c *Client) RemoteDir() string {
+	return c.remoteDir
+}
+
+// Test checks that the remote directory can be written to by running a
+// trivial command in it, as `New` does unless `DryRun` is set.
+func (c *Client) Test() error {
+	return c.checkRemoteWritable()
+}
@@ -0,0 +1,113 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/pkg/sftp"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+
+// Backends for file transfers, see `Options.Transfer`.
+const (
+	TransferAuto = "auto" // sftp if the remote offers it, otherwise scp
+	TransferSFTP = "sftp" // sftp only
+	TransferSCP  = "scp"  // scp only, sftp is not tried
+)
+
+// errNoSFTP is returned by uploads with `TransferSFTP` while there is no sftp
+// session, for example because it could not be reopened after a reconnect.
+var errNoSFTP = errors.New("sftp session unavailable")
+
+// checkTransfer returns an error if `opts.Transfer` is not a known backend.
+func checkTransfer(opts Options) error {
+	switch opts.Transfer {
+	case TransferAuto, TransferSFTP, TransferSCP:
+		return nil
+	}
+	return fmt.Errorf("unknown transfer backend %q, expected %s, %s or %s", opts.Transfer, TransferAuto, TransferSFTP, TransferSCP)
+}
+
+// transferer writes files to the remote, so that the rest of the client need
+// not know whether it is talking to scp or sftp.
+type transferer interface {
+	// Upload writes `sz` bytes from `src` to `dst`, which is created or
+	// truncated with the permission bits of `mode`.
+	Upload(src io.Reader, dst string, mode os.FileMode, sz int64) error
+}
+
+// scpTransfer runs a `scp` sink per file, see `Client.copy`.
+type scpTransfer struct {
+	c *Client
+}
+
+func (t scpTransfer) Upload(src io.Reader, dst string, mode os.FileMode, sz int64) error {
+	return t.c.copy(t.c.ctx, src, dst, fmt.Sprintf("%04o", mode.Perm()), sz)
+}
+
+// sftpTransfer writes over the persistent sftp session, which is nil if it
+// could not be opened.
+type sftpTransfer struct {
+	c  *Client
+	sc *sftp.Client
+}
+
+func (t sftpTransfer) Upload(src io.Reader, dst string, mode os.FileMode, sz int64) error {
+	if t.sc == nil {
+		return errNoSFTP
+	}
+	return sftpUpload(t.c.ctx, t.sc, src, dst, mode, sz)
+}
+
+// sftpUpload writes `sz` bytes from `src` to the file at `p`, which is created
+// or truncated with the permission bits `mode`.  The sftp package pipelines
+// the writes so that a high latency link does not limit throughput.
+// Cancelling `ctx` stops the upload part way and returns `ctx.Err()`.
+func sftpUpload(ctx context.Context, sc *sftp.Client, src io.Reader, p string, mode os.FileMode, sz int64) error {
+	f, err := sc.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		return err
+	}
+	err = f.Chmod(mode.Perm())
+	if err == nil {
+		var n int64
+		n, err = f.ReadFrom(ctxReader{ctx: ctx, r: io.LimitReader(src, sz)})
+		if err == nil && n < sz {
+			err = fmt.Errorf("short read, sent %d of %d bytes for %s", n, sz, p)
+		}
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// ctxReader reads from `r` until `ctx` is cancelled.
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r ctxReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
+// transferer returns the backend selected for the current connection.
+func (c *Client) transferer() transferer {
+	c.connLock.RLock()
+	defer c.connLock.RUnlock()
+	if c.transfer == nil {
+		return scpTransfer{c: c}
+	}
+	return c.transfer
+}
@@ -0,0 +1,67 @@
+package client
+
+import (
+	"bytes"
+	"io"
+	"os/exec"
+	"path/filepath"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TransformFunc rewrites the contents of a file before it is uploaded.  It
+// returns the transformed contents along with their size in bytes, which is
+// what gets advertised to the remote.
+type TransformFunc func(io.Reader) (io.Reader, int64, error)
+
+type transform struct {
+	pattern string
+	fn      TransformFunc
+}
+
+// AddTransform registers `fn` to be applied to files which match the glob
+// `pattern` before they are uploaded.  The pattern is matched against both the
+// file's name and its path relative to the local directory.  Transforms are
+// consulted in the order they were added and the first match wins.
+func (c *Client) AddTransform(pattern string, fn func(io.Reader) (io.Reader, int64, error)) {
+	c.transforms = append(c.transforms, transform{pattern: pattern, fn: fn})
+}
+
+// transformFor returns the transform which applies to the local file at the
+// absolute path `local`, or nil if there is none.
+func (c *Client) transformFor(local string) TransformFunc {
+	if len(c.transforms) == 0 {
+		return nil
+	}
+
+	rel := local
+	if localDir, err := filepath.Abs(c.localDir); err == nil {
+		if r, err := filepath.Rel(localDir, local); err == nil {
+			rel = r
+		}
+	}
+
+	for _, t := range c.transforms {
+		if ok, _ := filepath.Match(t.pattern, filepath.Base(local)); ok {
+			return t.fn
+		}
+		if ok, _ := filepath.Match(t.pattern, rel); ok {
+			return t.fn
+		}
+	}
+	return nil
+}
+
+// CommandTransform returns a `TransformFunc` which pipes the file's contents
+// through the local shell command `cmd` and uploads its output.
+func CommandTransform(cmd string) TransformFunc {
+	return func(r io.Reader) (io.Reader, int64, error) {
+		var out bytes.Buffer
+		proc := exec.Command("sh", "-c", cmd)
+		proc.Stdin, proc.Stdout = r, &out
+		if err := proc.Run(); err != nil {
+			return nil, 0, err
+		}
+		return &out, int64(out.Len()), nil
+	}
+}
@@ -0,0 +1,80 @@
+package client
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+
+	"golang.org/x/crypto/ssh"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+
+// verboseLogger prints details of how the connection is made, see
+// `Options.Verbose`.
+type verboseLogger struct {
+	level  int       // messages above this level are dropped
+	redact bool      // see `Options.Redact`
+	out    io.Writer // where messages are written
+}
+
+// newVerboseLogger returns a `verboseLogger` for the options.
+func newVerboseLogger(opts Options) verboseLogger {
+	l := verboseLogger{
+		level:  opts.Verbose,
+		redact: opts.Redact,
+		out:    opts.VerboseOutput,
+	}
+	if l.out == nil {
+		l.out = os.Stderr
+	}
+	return l
+}
+
+// printf prints the message if the verbosity is at least `level`.  Like
+// OpenSSH, messages are prefixed with "debug" and their level.
+func (l verboseLogger) printf(level int, format string, args ...interface{}) {
+	if l.level < level {
+		return
+	}
+	msg := fmt.Sprintf(format, args...)
+	if l.redact {
+		msg = Redact(msg)
+	}
+	fmt.Fprintf(l.out, "\rdebug%d: %s\n", level, msg)
+}
+
+// signer logs when the server accepts a key offered for authentication.
+func (l verboseLogger) signer(name string, k ssh.Signer) ssh.Signer {
+	if l.level < 1 {
+		return k
+	}
+	l.printf(1, "Offering %s key %s from %s", k.PublicKey().Type(), ssh.FingerprintSHA256(k.PublicKey()), name)
+	return &loggedSigner{Signer: k, log: l, name: name}
+}
+
+// hostKeyCallback logs the host key presented by the server before checking
+// it with `check`.
+func (l verboseLogger) hostKeyCallback(check ssh.HostKeyCallback) ssh.HostKeyCallback {
+	if l.level < 1 {
+		return check
+	}
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		l.printf(1, "Server host key: %s %s", key.Type(), ssh.FingerprintSHA256(key))
+		return check(hostname, remote, key)
+	}
+}
+
+// loggedSigner wraps a `ssh.Signer` to log when it is used.  The client only
+// signs with a key once the server has said that it would accept it.
+type loggedSigner struct {
+	ssh.Signer
+	log  verboseLogger
+	name string
+}
+
+func (s *loggedSigner) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+	s.log.printf(1, "Server accepts key %s from %s", ssh.FingerprintSHA256(s.PublicKey()), s.name)
+	return s.Signer.Sign(rand, data)
+}
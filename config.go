@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+
+// defaultConfigPath is the config file read from the working directory when
+// `-config` is not given.
+const defaultConfigPath = ".pssh.yaml"
+
+// autoConfigKeys are the settings which a `defaultConfigPath` found in the
+// working directory may set.  It comes along with whatever is checked out, so
+// settings which run commands, weaken host checks, delete remote files or
+// write local files must come from a file given with `-config` instead, and
+// are skipped with a warning otherwise.
+var autoConfigKeys = map[string]bool{
+	"address": true, "local": true, "remote": true, "port": true, "user": true, "timeout": true,
+	"recursive": true, "follow-new-dirs": true, "symlinks": true, "times": true,
+	"strip-prefix": true, "add-prefix": true, "exclude-vcs": true, "sync-editor-temp": true,
+	"ext": true, "include": true, "max-size": true,
+	"skip-sync": true, "once": true, "no-shell": true, "sync-first": true, "dry-run": true,
+	"force": true, "inplace": true,
+	"max-sessions": true, "workers": true, "max-open": true, "keepalive": true,
+	"max-retries": true, "idle-timeout": true, "debounce": true,
+	"dedup": true, "delta": true, "delta-min-size": true, "limit": true,
+	"compress": true, "compress-min-size": true, "marker": true, "max-clock-skew": true,
+	"tty-echo": true, "v": true, "vv": true, "log-json": true, "quiet": true, "redact": true,
+	"transfer": true, "remote-os": true,
+	"command-retries": true, "transfer-retries": true, "retry-delay": true,
+}
+
+// projectConfig is a parsed config file.  Settings are keyed by the name of
+// the flag they set, with the remote addresses under "address".
+type projectConfig struct {
+	path     string
+	settings map[string][]string
+	order    []string // keys in the order they appear, for stable errors
+	explicit bool     // given with `-config`, rather than found, see `autoConfigKeys`
+}
+
+// loadConfig reads the config file at `path`.  The file is a small subset of
+// YAML: one `key: value` per line, with lists given either inline as
+// `[a, b]` or as `- item` lines below the key, and `#` comments.
+//
+//	address: user@foobar.com:/srv/app
+//	compress: true
+//	include: [*.go, templates/*.html]
+//	remote:
+//	  - /srv/app
+//	  - /srv/backup/app
+func loadConfig(path string) (*projectConfig, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	cfg := &projectConfig{path: path, settings: map[string][]string{}}
+	key, n := "", 0
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		n++
+		line := strings.TrimSpace(stripComment(s.Text()))
+		if len(line) == 0 {
+			continue
+		}
+
+		if strings.HasPrefix(line, "- ") || line == "-" {
+			if len(key) == 0 {
+				return nil, fmt.Errorf("%s:%d: list item without a key", path, n)
+			}
+			cfg.settings[key] = append(cfg.settings[key], unquote(strings.TrimSpace(line[1:])))
+			continue
+		}
+
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected key: value", path, n)
+		}
+		key = strings.TrimSpace(parts[0])
+		if _, ok := cfg.settings[key]; ok {
+			return nil, fmt.Errorf("%s:%d: %s is set twice", path, n, key)
+		}
+		cfg.order = append(cfg.order, key)
+		cfg.settings[key] = parseConfigValue(strings.TrimSpace(parts[1]))
+	}
+	return cfg, s.Err()
+}
+
+// stripComment removes a trailing `#` comment from `line`, unless the `#` is
+// inside quotes or part of a word.
+func stripComment(line string) string {
+	quote := rune(0)
+	for i, r := range line {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '"' || r == '\'':
+			quote = r
+		case r == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// parseConfigValue splits an inline `[a, b]` list, or returns a scalar as a
+// list of one.  An empty value is the start of a block list.
+func parseConfigValue(v string) []string {
+	if len(v) == 0 {
+		return []string{}
+	}
+	if !strings.HasPrefix(v, "[") || !strings.HasSuffix(v, "]") {
+		return []string{unquote(v)}
+	}
+
+	items := []string{}
+	for _, item := range strings.Split(v[1:len(v)-1], ",") {
+		if item = strings.TrimSpace(item); len(item) > 0 {
+			items = append(items, unquote(item))
+		}
+	}
+	return items
+}
+
+// unquote removes matching single or double quotes around `s`.
+func unquote(s string) string {
+	if len(s) >= 2 && (s[0] == '"' || s[0] == '\'') && s[len(s)-1] == s[0] {
+		return s[1 : len(s)-1]
+	}
+	return s
+}
+
+// addresses returns the remote addresses from the config, if any.
+func (cfg *projectConfig) addresses() []string {
+	return cfg.settings["address"]
+}
+
+// apply sets each flag named in the config which was not given on the command
+// line, those in `set`.  Flags which may be repeated are set once for each
+// item in a list, others are given the items joined with commas.  Settings
+// which a found config may not make, see `autoConfigKeys`, are skipped.
+func (cfg *projectConfig) apply(set map[string]bool) error {
+	for _, key := range cfg.order {
+		if key == "address" {
+			continue
+		}
+		f := flag.Lookup(key)
+		if f == nil || key == "config" {
+			return fmt.Errorf("%s: unknown setting %q", cfg.path, key)
+		}
+		if set[key] {
+			continue
+		}
+		if !cfg.explicit && !autoConfigKeys[key] {
+			fmt.Printf("Warning: %s: ignoring %s, which may only be set in a config file given with -config\n", cfg.path, key)
+			continue
+		}
+
+		values := cfg.settings[key]
+		if !cfg.explicit && key == "local" && !insideWorkingDir(values) {
+			fmt.Printf("Warning: %s: ignoring local, which must be inside the working directory unless given with -config\n", cfg.path)
+			continue
+		}
+		switch f.Value.(type) {
+		case *listFlags, *transformFlags, *chmodFlags:
+		default:
+			values = []string{strings.Join(values, ",")}
+		}
+		for _, v := range values {
+			if err := f.Value.Set(v); err != nil {
+				return fmt.Errorf("%s: invalid value %q for %s: %s", cfg.path, v, key, err.Error())
+			}
+		}
+	}
+	return nil
+}
+
+// insideWorkingDir returns true if each of the local paths `paths` is relative
+// and does not climb out of the working directory.
+func insideWorkingDir(paths []string) bool {
+	for _, v := range paths {
+		if p := filepath.Clean(v); filepath.IsAbs(p) || p == ".." || strings.HasPrefix(p, ".."+string(filepath.Separator)) {
+			return false
+		}
+	}
+	return true
+}
+
+// loadProjectConfig applies the config file named by `-config`, or the
+// default one if it exists, and returns it.  It returns nil if there is no
+// config file.
+func loadProjectConfig(set map[string]bool) (*projectConfig, error) {
+	path := configPath
+	if len(path) == 0 {
+		if _, err := os.Stat(defaultConfigPath); err != nil {
+			return nil, nil
+		}
+		path = defaultConfigPath
+	}
+
+	cfg, err := loadConfig(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg.explicit = len(configPath) > 0
+	return cfg, cfg.apply(set)
+}
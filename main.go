@@ -1,10 +1,16 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/sabhiram/pssh/client"
 )
@@ -12,43 +18,522 @@ import (
 ////////////////////////////////////////////////////////////////////////////////
 
 var (
+	configPath      string
 	localDir        string
 	skipInitialSync bool
+	dedup           bool
+	marker          bool
+	delta           bool
+	deltaMinSize    int64
+	maxSessions     int
+	maxOpenFiles    int
+	maxClockSkew    time.Duration
+	strictClock     bool
+	transforms      transformFlags
+	chmodRules      chmodFlags
+	shellCmd        string
+	postCmd         string
+	postCmdOnChange bool
+	redact          bool
+	syncFirst       bool
+	commandRetries  int
+	transferRetries int
+	retryDelay      time.Duration
+	excludeVCS      bool
+	pidFile         string
+	extensions      string
+	include         string
+	manifest        string
+	insecure        bool
+	port            int
+	remoteUser      string
+	identity        string
+	sshDir          string
+	remoteDirs      listFlags
+	debounce        time.Duration
+	idleTimeout     time.Duration
+	once            bool
+	recursive       bool
+	keepAlive       time.Duration
+	maxRetries      int
+	compress        bool
+	compressMinSize int64
+	maxFileSize     int64
+	dryRun          bool
+	force           bool
+	inPlace         bool
+	deleteOrphans   bool
+	stripPrefix     string
+	addPrefix       string
+	followNewDirs   bool
+	logJSON         bool
+	quiet           bool
+	noShell         bool
+	pull            bool
+	testConn        bool
+	times           bool
+	ttyEcho         bool
+	scpPath         string
+	transfer        string
+	remoteOS        string
+	allowRoot       bool
+	syncWorkers     int
+	symlinks        string
+	verbose         bool
+	veryVerbose     bool
+	timeout         time.Duration
+	limit           int64
+	syncEditorTemp  bool
 )
 
+// transformFlags collects repeated `-transform pattern=command` flags.
+type transformFlags []string
+
+func (t *transformFlags) String() string {
+	return strings.Join(*t, ", ")
+}
+
+func (t *transformFlags) Set(s string) error {
+	if !strings.Contains(s, "=") {
+		return fmt.Errorf("expected pattern=command, got %q", s)
+	}
+	*t = append(*t, s)
+	return nil
+}
+
+// writePidFile writes the PID of this process to `path`.  An existing file is
+// assumed to be left over from a previous run and is overwritten.
+func writePidFile(path string) error {
+	if bs, err := ioutil.ReadFile(path); err == nil {
+		fmt.Printf("Warning: overwriting stale pid file %s (pid %s)\n", path, strings.TrimSpace(string(bs)))
+	}
+	return ioutil.WriteFile(path, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644)
+}
+
+// removePidFile removes the pid file if one was requested.
+func removePidFile() {
+	if len(pidFile) > 0 {
+		os.Remove(pidFile)
+	}
+}
+
+// chmodFlags collects repeated `-chmod-rule pattern=mode` flags.
+type chmodFlags []client.ChmodRule
+
+func (c *chmodFlags) String() string {
+	rules := []string{}
+	for _, r := range *c {
+		rules = append(rules, fmt.Sprintf("%s=%04o", r.Pattern, r.Mode))
+	}
+	return strings.Join(rules, ", ")
+}
+
+func (c *chmodFlags) Set(s string) error {
+	r, err := client.ParseChmodRule(s)
+	if err != nil {
+		return err
+	}
+	*c = append(*c, r)
+	return nil
+}
+
+// listFlags collects the values of a flag which may be repeated.
+type listFlags []string
+
+func (l *listFlags) String() string {
+	return strings.Join(*l, ", ")
+}
+
+func (l *listFlags) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+// splitList splits a comma separated flag value, dropping empty entries.
+func splitList(s string) []string {
+	ret := []string{}
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); len(v) > 0 {
+			ret = append(ret, v)
+		}
+	}
+	return ret
+}
+
+// exitIdleTimeout is the exit status once `-idle-timeout` passes without a
+// change, so that scripts can tell it apart from other ways pssh stops.
+const exitIdleTimeout = 3
+
 func fatalOnError(err error) {
 	if err != nil {
-		fmt.Printf("Fatal error: %s\n", err.Error())
+		msg := err.Error()
+		if redact {
+			msg = client.Redact(msg)
+		}
+		fmt.Fprintf(os.Stderr, "Fatal error: %s\n", msg)
+		removePidFile()
 		os.Exit(1)
 	}
 }
 
+// exists returns true if `p` is an existing local path.
+func exists(p string) bool {
+	_, err := os.Stat(p)
+	return err == nil
+}
+
+// looksLikeAddr returns true if `s` appears to be a remote address rather than
+// a local path.  Existing local paths are never considered addresses.
+func looksLikeAddr(s string) bool {
+	if exists(s) {
+		return false
+	}
+	return strings.ContainsAny(s, "@:")
+}
+
+// parseArgs returns the remote addresses and local directory from the
+// positional arguments.  Both `pssh <addr>...` and the scp-like
+// `pssh <local> <addr>...` forms are accepted, as is `pssh <addr> <local>` for
+// a single host.
+func parseArgs(args []string, localSet bool) ([]string, string, error) {
+	withLocal := func(addrs []string, local string) ([]string, string, error) {
+		if localSet {
+			return nil, "", errors.New("local directory specified by both -local and a positional argument")
+		}
+		return addrs, local, nil
+	}
+
+	switch len(args) {
+	case 0:
+		return nil, "", errors.New("expected arguments: [local] <address>...")
+	case 1:
+		return args, localDir, nil
+	case 2:
+		a, b := looksLikeAddr(args[0]), looksLikeAddr(args[1])
+		switch {
+		case a && b:
+			return args, localDir, nil
+		case a && !b:
+			return withLocal(args[:1], args[1])
+		case b && !a:
+			return withLocal(args[1:], args[0])
+		}
+
+		// A bare host alias from ~/.ssh/config, ex: `pssh . prod`.
+		if exists(args[0]) && !exists(args[1]) {
+			return withLocal(args[1:], args[0])
+		} else if exists(args[1]) && !exists(args[0]) {
+			return withLocal(args[:1], args[1])
+		} else if !exists(args[0]) && !exists(args[1]) && localSet {
+			return args, localDir, nil
+		}
+		return nil, "", fmt.Errorf("unable to tell which of %q and %q is the remote address", args[0], args[1])
+	}
+
+	// With several hosts the local directory, if given, comes first.
+	if exists(args[0]) {
+		return withLocal(args[1:], args[0])
+	}
+	return args, localDir, nil
+}
+
+// verbosity returns the level of detail requested by `-v` and `-vv`.
+func verbosity() int {
+	if veryVerbose {
+		return 2
+	} else if verbose {
+		return 1
+	}
+	return 0
+}
+
+// usage prints how to invoke pssh along with the available flags.
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "usage: pssh [flags] [local] <address>...\n\n")
+	fmt.Fprintf(out, "The address is one of:\n")
+	fmt.Fprintf(out, "  user[:pass]@host[:port][:/remote/dir]\n")
+	fmt.Fprintf(out, "  user[:pass]@[ipv6]:port[:/remote/dir]\n")
+	fmt.Fprintf(out, "  docker://container:/remote/dir\n")
+	fmt.Fprintf(out, "  k8s://pod:/remote/dir\n\n")
+	fmt.Fprintf(out, "Addresses and flag defaults may be kept in %s, see -config.\n\n", defaultConfigPath)
+	fmt.Fprintf(out, "Examples:\n")
+	fmt.Fprintf(out, "  pssh user@foobar.com:/tmp/foobar\n")
+	fmt.Fprintf(out, "  pssh ./src user@foobar.com:2222:/tmp/foobar\n")
+	fmt.Fprintf(out, "  pssh ./src user@web1:/srv/app user@web2:/srv/app\n\n")
+	fmt.Fprintf(out, "Flags:\n")
+	flag.PrintDefaults()
+}
+
+// testConnections connects to each of `addrs`, and each remote directory of
+// them, and checks that the remote directory can be written to.  It prints OK
+// or FAIL for each along with where the address resolved to, and returns the
+// exit status, which is non-zero if any failed.
+func testConnections(addrs []string, localDir string, opts client.Options) int {
+	dirs := opts.RemoteDirs
+	if len(dirs) == 0 {
+		dirs = []string{opts.RemoteDir}
+	}
+	opts.Quiet = true
+
+	code := 0
+	for _, addr := range addrs {
+		for _, dir := range dirs {
+			o := opts
+			o.RemoteDir = dir
+
+			info, err := client.Resolve(addr, o)
+			if err == nil {
+				var cli *client.Client
+				if cli, err = client.New(addr, localDir, o); err == nil {
+					info.RemoteDir = cli.RemoteDir()
+					err = cli.Test()
+					cli.Close()
+				}
+			}
+
+			msg := fmt.Sprintf("OK   %s", info)
+			if err != nil {
+				msg = fmt.Sprintf("FAIL %s: %s", info, err)
+				if info == (client.ConnInfo{}) {
+					msg = fmt.Sprintf("FAIL %s", err)
+				}
+				code = 1
+			}
+			if redact {
+				msg = client.Redact(msg)
+			}
+			fmt.Println(msg)
+		}
+	}
+	return code
+}
+
 func main() {
-	connAddr := flag.Args()[0]
-	client, err := client.New(connAddr, localDir)
+	// Flags given on the command line take precedence over the config file.
+	set := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	cfg, err := loadProjectConfig(set)
 	fatalOnError(err)
-	defer client.Close()
 
-	go client.StartShell(skipInitialSync)
+	args := flag.Args()
+	if cfg != nil && len(cfg.addresses()) > 0 {
+		if len(args) == 0 {
+			args = cfg.addresses()
+		} else if len(args) == 1 && !looksLikeAddr(args[0]) && exists(args[0]) {
+			args = append(args, cfg.addresses()...)
+		}
+	}
+	if len(args) == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	addrs, localDir, err := parseArgs(args, set["local"])
+	fatalOnError(err)
+
+	opts := client.Options{
+		Dedup:              dedup,
+		Marker:             marker,
+		Delta:              delta,
+		DeltaMinSize:       deltaMinSize,
+		MaxClockSkew:       maxClockSkew,
+		StrictClock:        strictClock,
+		MaxSessions:        maxSessions,
+		MaxOpenFiles:       maxOpenFiles,
+		SyncWorkers:        syncWorkers,
+		Symlinks:           symlinks,
+		Verbose:            verbosity(),
+		ShellCmd:           shellCmd,
+		PostCmd:            postCmd,
+		PostCmdOnChange:    postCmdOnChange,
+		TTYEcho:            ttyEcho,
+		SCPPath:            scpPath,
+		Transfer:           transfer,
+		RemoteOS:           remoteOS,
+		AllowRoot:          allowRoot,
+		Redact:             redact,
+		SyncFirst:          syncFirst,
+		CommandRetries:     commandRetries,
+		TransferRetries:    transferRetries,
+		TransferRetryDelay: retryDelay,
+		ExcludeVCS:         excludeVCS,
+		SyncEditorTemp:     syncEditorTemp,
+		Extensions:         splitList(extensions),
+		Include:            splitList(include),
+		Manifest:           manifest,
+		Insecure:           insecure,
+		Port:               port,
+		User:               remoteUser,
+		Timeout:            timeout,
+		Identity:           identity,
+		SSHDir:             sshDir,
+		RemoteDirs:         remoteDirs,
+		Debounce:           debounce,
+		IdleTimeout:        idleTimeout,
+		NonRecursive:       !recursive,
+		FollowNewDirs:      followNewDirs,
+		NoTimes:            !times,
+		KeepAlive:          keepAlive,
+		MaxRetries:         maxRetries,
+		Compress:           compress,
+		RateLimit:          limit * 1024,
+		CompressMinSize:    compressMinSize,
+		MaxFileSize:        maxFileSize,
+		DryRun:             dryRun,
+		Force:              force,
+		ChmodRules:         chmodRules,
+		InPlace:            inPlace,
+		StripPrefix:        stripPrefix,
+		AddPrefix:          addPrefix,
+		Delete:             deleteOrphans,
+		LogJSON:            logJSON,
+		Quiet:              quiet,
+	}
+
+	if testConn {
+		os.Exit(testConnections(addrs, localDir, opts))
+	}
+
+	if len(pidFile) > 0 {
+		fatalOnError(writePidFile(pidFile))
+		defer removePidFile()
+	}
+
+	cli, err := client.NewGroup(addrs, localDir, opts)
+	fatalOnError(err)
+	defer cli.Close()
+
+	for _, t := range transforms {
+		parts := strings.SplitN(t, "=", 2)
+		cli.AddTransform(parts[0], client.CommandTransform(parts[1]))
+	}
+
+	if pull {
+		err := cli.Pull()
+		if err != nil {
+			cli.Close()
+		}
+		fatalOnError(err)
+		return
+	}
+
+	if once {
+		err := cli.SyncOnce()
+		if err != nil {
+			cli.Close()
+		}
+		fatalOnError(err)
+		return
+	}
+
+	if noShell {
+		go cli.Watch(skipInitialSync)
+	} else {
+		go cli.StartShell(skipInitialSync)
+	}
 
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
-	func() {
-		for {
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+
+	// Closing the client waits for the shell to restore the terminal, so
+	// only report why we stopped once it returns.
+	code := 0
+	select {
+	case sig := <-c:
+		go func() {
+			// A second signal gives up on closing cleanly.
 			<-c
-			fmt.Printf("Got Ctrl+C\n")
+			removePidFile()
 			os.Exit(1)
+		}()
+		cli.Close()
+		if !quiet {
+			fmt.Printf("\rGot %s, exiting\n", sig)
+		}
+	case <-cli.Done():
+		cli.Close()
+		if cli.IdleTimedOut() {
+			code = exitIdleTimeout
+			break
 		}
-	}()
+		fmt.Fprintf(os.Stderr, "\r%s\n", cli.Err())
+		code = 1
+	}
+	cli.Report()
+	removePidFile()
+	os.Exit(code)
 }
 
 func init() {
-	flag.StringVar(&localDir, "local", "./", "local directory to push to the remote")
+	flag.StringVar(&configPath, "config", "", "path to a config file of flag defaults, .pssh.yaml in the working directory is read if it exists but is ignored for flags which run commands, relax host key checks, delete remote files or write local files")
+	flag.StringVar(&localDir, "local", "./", "local directory, or single file, to push to the remote")
+	flag.IntVar(&port, "port", 0, "port to connect to, overrides the port in the address")
+	flag.StringVar(&remoteUser, "user", "", "user to log in to the remote as, overrides the user in the address")
+	flag.DurationVar(&timeout, "timeout", client.DefaultTimeout, "how long to wait when connecting to the remote")
+	flag.StringVar(&identity, "identity", "", "path to the private key to authenticate with")
+	flag.StringVar(&sshDir, "ssh-dir", "", "directory to look for private keys in instead of ~/.ssh, defaults to $"+client.SSHDirEnv)
+	flag.Var(&remoteDirs, "remote", "remote directory to sync to, overrides the one in the address, may be repeated to sync to several")
+	flag.BoolVar(&allowRoot, "allow-root", false, "if true, allow syncing to / on the remote")
 	flag.BoolVar(&skipInitialSync, "skip-sync", false, "if true, will skip the initial sync")
+	flag.BoolVar(&once, "once", false, "if true, sync the local directory once and exit without starting a shell")
+	flag.BoolVar(&noShell, "no-shell", false, "if true, keep the remote in sync without opening a shell, for use in the background")
+	flag.BoolVar(&pull, "pull", false, "if true, mirror the remote directory into the local one once and exit")
+	flag.BoolVar(&testConn, "test", false, "if true, check that each address can be connected to and its remote directory written to, print OK or FAIL for each and exit")
+	flag.BoolVar(&recursive, "recursive", true, "if false, only watch and sync files directly inside the local directory")
+	flag.BoolVar(&followNewDirs, "follow-new-dirs", false, "if true, explicitly watch each directory created after startup, for platforms where the recursive watch misses them")
+	flag.StringVar(&symlinks, "symlinks", client.SymlinksFollow, "how to sync symlinks: follow to sync what they point to, copy to recreate them on the remote, or skip")
+	flag.BoolVar(&times, "times", true, "if true, give synced files the modification time of the local file")
+	flag.BoolVar(&force, "force", false, "if true, transfer every file even if the remote copy is unchanged")
+	flag.BoolVar(&deleteOrphans, "delete", false, "if true, remove remote files with no local copy after the initial sync, otherwise they are reported")
+	flag.StringVar(&stripPrefix, "strip-prefix", "", "local path prefix to remove from files under it on the remote (ex: src/foo puts src/foo/bar.js at bar.js)")
+	flag.StringVar(&addPrefix, "add-prefix", "", "path to put every file under on the remote, after -strip-prefix (ex: dist)")
+	flag.BoolVar(&inPlace, "inplace", false, "if true, write files straight to their destination rather than renaming a temporary file into place")
+	flag.BoolVar(&dryRun, "dry-run", false, "if true, print what would be synced without changing the remote")
+	flag.BoolVar(&syncFirst, "sync-first", false, "if true, finish the initial sync before starting the shell")
+	flag.BoolVar(&insecure, "insecure", false, "if true, do not verify the remote host key against known_hosts")
+	flag.IntVar(&maxSessions, "max-sessions", client.DefaultMaxSessions, "maximum number of ssh sessions to open on the connection at once")
+	flag.IntVar(&syncWorkers, "workers", client.DefaultSyncWorkers, "number of files to transfer at once during the initial sync, and of changes to sync at once after it")
+	flag.IntVar(&maxOpenFiles, "max-open", client.DefaultMaxOpenFiles(), "maximum number of local files to hold open for transfer at once")
+	flag.BoolVar(&excludeVCS, "exclude-vcs", true, "if true, skip .git, .svn, .hg, .bzr, CVS and _darcs directories")
+	flag.BoolVar(&syncEditorTemp, "sync-editor-temp", false, "if true, also sync editor swap, backup and temp files (ex: .swp, ~, 4913)")
+	flag.StringVar(&extensions, "ext", "", "comma separated list of file extensions to restrict syncing to (ex: go,mod,sum)")
+	flag.StringVar(&include, "include", "", "comma separated list of glob patterns, only matching files are synced (ex: *.go,templates/*.html)")
+	flag.DurationVar(&keepAlive, "keepalive", client.DefaultKeepAlive, "interval between keepalive requests to the server, 0 to disable")
+	flag.IntVar(&maxRetries, "max-retries", client.DefaultMaxRetries, "number of times to try to reconnect after the connection drops, 0 to exit instead")
+	flag.DurationVar(&idleTimeout, "idle-timeout", 0, "exit with status 3 once this long passes after the initial sync without a change, 0 to wait forever")
+	flag.DurationVar(&debounce, "debounce", client.DefaultDebounce, "how long a changed file must be quiet before it is synced, 0 to disable")
+	flag.BoolVar(&dedup, "dedup", false, "if true, hardlink files which already exist on the remote instead of copying them")
+	flag.BoolVar(&delta, "delta", false, "if true, only send the changed blocks of large files")
+	flag.Int64Var(&deltaMinSize, "delta-min-size", client.DefaultDeltaMinSize, "minimum file size in bytes to transfer as a delta")
+	flag.Int64Var(&limit, "limit", 0, "maximum upload rate in KB/s combined across all remotes, 0 for unlimited")
+	flag.BoolVar(&compress, "compress", false, "if true, gzip compressible files in transit")
+	flag.Int64Var(&compressMinSize, "compress-min-size", client.DefaultCompressMinSize, "minimum file size in bytes to compress")
+	flag.Int64Var(&maxFileSize, "max-size", 0, "largest file size in bytes to sync, larger files are skipped with a warning, 0 for unlimited")
+	flag.BoolVar(&marker, "marker", false, "if true, skip the initial sync when the remote marker matches the local tree")
+	flag.DurationVar(&maxClockSkew, "max-clock-skew", client.DefaultMaxClockSkew, "largest tolerated difference between the local and remote clocks")
+	flag.BoolVar(&strictClock, "strict-clock", false, "if true, fail when the clock skew exceeds -max-clock-skew")
+	flag.StringVar(&shellCmd, "shell-cmd", "", "interactive command to run on the remote instead of the login shell")
+	flag.StringVar(&postCmd, "post-cmd", "", "command to run on the remote after the initial sync (ex: systemctl restart app)")
+	flag.BoolVar(&postCmdOnChange, "post-cmd-on-change", false, "if true, also run -post-cmd after each burst of changes is synced")
+	flag.BoolVar(&ttyEcho, "tty-echo", false, "if true, have the remote terminal echo input, for shells where typing is otherwise invisible")
+	flag.BoolVar(&verbose, "v", false, "if true, print each step of connecting and authenticating")
+	flag.BoolVar(&veryVerbose, "vv", false, "if true, print even more detail than -v, including each key file tried")
+	flag.BoolVar(&logJSON, "log-json", false, "if true, log events and their results as one JSON object per line")
+	flag.BoolVar(&quiet, "quiet", false, "if true, only print errors, combined with -log-json only failed events are logged")
+	flag.BoolVar(&redact, "redact", false, "if true, hide home directories and secrets in status output")
+	flag.StringVar(&transfer, "transfer", client.TransferAuto, "how to write files to the remote: auto to use sftp if the remote offers it and scp otherwise, sftp or scp")
+	flag.StringVar(&scpPath, "scp-path", client.DefaultSCPPath, "path to scp on the remote, used when sftp is unavailable")
+	flag.StringVar(&remoteOS, "remote-os", client.RemoteOSPOSIX, "shell syntax of the remote: posix, or windows for windows OpenSSH servers")
+	flag.IntVar(&commandRetries, "command-retries", 0, "number of times to retry a remote command which fails to run")
+	flag.IntVar(&transferRetries, "transfer-retries", client.DefaultTransferRetries, "number of times to retry a file transfer which fails, 0 to give up at once")
+	flag.DurationVar(&retryDelay, "retry-delay", client.DefaultTransferRetryDelay, "wait before the first retry of a failed transfer, doubled for each retry after")
+	flag.StringVar(&manifest, "manifest", "", "path to write a JSON manifest of synced files to, with several addresses each is added to the name before the extension")
+	flag.StringVar(&pidFile, "pidfile", "", "path to write the process id to while running")
+	flag.Var(&chmodRules, "chmod-rule", "pattern=mode giving matching files those permissions on the remote (ex: *.sh=0755), may be repeated and the first match wins, other files keep their local permissions")
+	flag.Var(&transforms, "transform", "pattern=command to pipe matching files through before upload, may be repeated")
+	flag.Usage = usage
 	flag.Parse()
 }
-
-/*
-TODO:
-	folder creation does not work :) - it makes a remote file instead?
-*/